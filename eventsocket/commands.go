@@ -0,0 +1,1352 @@
+// Copyright 2013 Alexandre Fiori
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package eventsocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// checkArgs returns errInvalidCommand if any of the arguments contains \r
+// or \n, which would otherwise break the command framing.
+func checkArgs(args ...string) error {
+	for _, arg := range args {
+		if strings.ContainsAny(arg, "\r\n") {
+			return errInvalidCommand
+		}
+	}
+	return nil
+}
+
+// checkWords returns errInvalidArg if any of the arguments is empty or
+// contains whitespace. It's used for uuids, names and other arguments that
+// must not be split by the server.
+func checkWords(args ...string) error {
+	for _, arg := range args {
+		if arg == "" || strings.IndexFunc(arg, unicode.IsSpace) >= 0 {
+			return errInvalidArg
+		}
+	}
+	return nil
+}
+
+// sendAPI sends an api command made of args separated by spaces, and returns
+// the response Event.
+func (h *Connection) sendAPI(args ...string) (*Event, error) {
+	if err := checkArgs(args...); err != nil {
+		return nil, err
+	}
+	return h.Send("api " + strings.Join(args, " "))
+}
+
+// Eval evaluates expr on the server, substituting variables such as
+// ${hostname}, and returns the result.
+//
+// Example:
+//
+//	Eval("${domain}")
+//
+// See https://freeswitch.org/confluence/display/FREESWITCH/mod_commands#eval
+// for details.
+func (h *Connection) Eval(expr string) (string, error) {
+	ev, err := h.sendAPI("eval", expr)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(ev.Body), nil
+}
+
+// SessionGetVar returns the value of a variable of the channel attached to
+// an outbound connection, using the event socket's own getvar command rather
+// than uuid_getvar. An unset variable returns an empty string.
+//
+// See https://freeswitch.org/confluence/display/FREESWITCH/mod_event_socket#getvar
+// for details.
+func (h *Connection) SessionGetVar(name string) (string, error) {
+	if err := checkArgs(name); err != nil {
+		return "", err
+	}
+	ev, err := h.Send("getvar " + name)
+	if err != nil {
+		return "", err
+	}
+	return ev.Get("Reply-Text"), nil
+}
+
+// ConferenceRecord starts recording the conference name to path.
+//
+// See https://freeswitch.org/confluence/display/FREESWITCH/mod_conference
+// for details.
+func (h *Connection) ConferenceRecord(name, path string) (*Event, error) {
+	if err := checkWords(name, path); err != nil {
+		return nil, err
+	}
+	return h.sendAPI("conference", name, "record", path)
+}
+
+// ConferenceStopRecord stops the recording of the conference name to path.
+// Use "all" as path to stop all recordings of the conference.
+func (h *Connection) ConferenceStopRecord(name, path string) (*Event, error) {
+	if err := checkWords(name, path); err != nil {
+		return nil, err
+	}
+	return h.sendAPI("conference", name, "norecord", path)
+}
+
+// ConferenceRelate sets the relationship between the members a and b of
+// the conference name. flags is nospeak (b doesn't hear a), nohear (a
+// doesn't hear b), sendvideo, a comma separated combination of them, or
+// clear to reset the relationship. Members are member IDs, or lists of them
+// separated by commas.
+//
+// Example, to let a coach whisper to an agent without the customer hearing:
+//
+//	ConferenceRelate("3000", coach, customer, "nospeak")
+func (h *Connection) ConferenceRelate(name, a, b, flags string) (*Event, error) {
+	if err := checkWords(name, a, b, flags); err != nil {
+		return nil, err
+	}
+	return h.sendAPI("conference", name, "relate", a, b, flags)
+}
+
+// show runs "show <what> as json" and returns the resulting rows.
+func (h *Connection) show(what string) ([]map[string]string, error) {
+	var rows []map[string]string
+	err := h.ShowStream(what, func(row map[string]string) error {
+		rows = append(rows, row)
+		return nil
+	})
+	return rows, err
+}
+
+// ShowStream runs "show <what> as json" and calls fn for each row of the
+// result as it's decoded, rather than decoding all rows at once. It stops
+// and returns the first error returned by fn.
+//
+// Example:
+//
+//	ShowStream("registrations", func(row map[string]string) error {
+//		fmt.Println(row["reg_user"], row["network_ip"])
+//		return nil
+//	})
+func (h *Connection) ShowStream(what string, fn func(row map[string]string) error) error {
+	if err := checkWords(what); err != nil {
+		return err
+	}
+	ev, err := h.sendAPI("show", what, "as", "json")
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(strings.NewReader(ev.Body))
+	if err = expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if key != "rows" {
+			var skip json.RawMessage
+			if err = dec.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = expectDelim(dec, '['); err != nil {
+			return err
+		}
+		for dec.More() {
+			var row map[string]string
+			if err = dec.Decode(&row); err != nil {
+				return err
+			}
+			if err = fn(row); err != nil {
+				return err
+			}
+		}
+		if err = expectDelim(dec, ']'); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// expectDelim reads the next token from dec and checks that it's delim.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != delim {
+		return fmt.Errorf("Unexpected JSON token %v, want %v", t, delim)
+	}
+	return nil
+}
+
+// ScheduledTask is a task of the FreeSWITCH scheduler, e.g. one created by
+// sched_hangup or sched_api.
+type ScheduledTask struct {
+	ID          int
+	Description string
+	Group       string
+	Runtime     time.Time
+	Hostname    string
+}
+
+// ShowScheduledTasks returns the tasks pending in the scheduler, as listed by
+// "show tasks".
+func (h *Connection) ShowScheduledTasks() ([]ScheduledTask, error) {
+	rows, err := h.show("tasks")
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]ScheduledTask, len(rows))
+	for n, row := range rows {
+		id, err := strconv.Atoi(row["task_id"])
+		if err != nil {
+			return nil, err
+		}
+		runtime, err := strconv.ParseInt(row["task_runtime"], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		tasks[n] = ScheduledTask{
+			ID:          id,
+			Description: row["task_desc"],
+			Group:       row["task_group"],
+			Runtime:     time.Unix(runtime, 0),
+			Hostname:    row["hostname"],
+		}
+	}
+	return tasks, nil
+}
+
+// CallPair is a call between two bridged channels, as listed by ShowCalls.
+type CallPair struct {
+	UUID            string // A leg
+	CallerIDName    string
+	CallerIDNumber  string
+	Destination     string
+	CalleeNumber    string
+	CallState       string // e.g. ACTIVE or HELD
+	Created         time.Time
+	BUUID           string // B leg, empty if not bridged
+	BCallerIDName   string
+	BCallerIDNumber string
+}
+
+// ShowCalls returns the calls in progress, as listed by "show calls".
+func (h *Connection) ShowCalls() ([]CallPair, error) {
+	rows, err := h.show("calls")
+	if err != nil {
+		return nil, err
+	}
+	calls := make([]CallPair, len(rows))
+	for n, row := range rows {
+		var created time.Time
+		if v := row["created_epoch"]; v != "" {
+			epoch, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			created = time.Unix(epoch, 0)
+		}
+		calls[n] = CallPair{
+			UUID:            row["uuid"],
+			CallerIDName:    row["cid_name"],
+			CallerIDNumber:  row["cid_num"],
+			Destination:     row["dest"],
+			CalleeNumber:    row["callee_num"],
+			CallState:       row["callstate"],
+			Created:         created,
+			BUUID:           row["b_uuid"],
+			BCallerIDName:   row["b_cid_name"],
+			BCallerIDNumber: row["b_cid_num"],
+		}
+	}
+	return calls, nil
+}
+
+// SchedDel removes a scheduled task by its ID, or all tasks of a group.
+//
+// Example:
+//
+//	SchedDel("3")
+//	SchedDel(uuid) // groups created by sched_hangup are the channel uuid
+func (h *Connection) SchedDel(idOrGroup string) (*Event, error) {
+	if err := checkWords(idOrGroup); err != nil {
+		return nil, err
+	}
+	return h.sendAPI("sched_del", idOrGroup)
+}
+
+// SetVar sets the channel variable name to value on the channel uuid. An
+// empty value unsets the variable.
+//
+// See https://freeswitch.org/confluence/display/FREESWITCH/mod_commands#uuid_setvar
+// for details.
+func (h *Connection) SetVar(uuid, name, value string) (*Event, error) {
+	if err := checkWords(uuid, name); err != nil {
+		return nil, err
+	}
+	if value == "" {
+		return h.sendAPI("uuid_setvar", uuid, name)
+	}
+	return h.sendAPI("uuid_setvar", uuid, name, value)
+}
+
+var errNoDefaults = errors.New("No default channel variables set")
+
+// SetDefaults sets the channel variables applied by ApplyDefaults, e.g. the
+// variables every call handled by the connection should have. They're kept
+// with the connection, so a handler taking over a call can apply them too.
+// Values can't contain whitespace or ;, which uuid_setvar_multi can't take.
+func (h *Connection) SetDefaults(vars map[string]string) error {
+	v := make(map[string]string, len(vars))
+	for name, value := range vars {
+		if err := checkWords(name); err != nil {
+			return err
+		}
+		if strings.ContainsAny(name, "=;") || strings.Contains(value, ";") ||
+			strings.IndexFunc(value, unicode.IsSpace) >= 0 {
+			return errInvalidArg
+		}
+		v[name] = value
+	}
+	h.mu.Lock()
+	h.defaults = v
+	h.mu.Unlock()
+	return nil
+}
+
+// ApplyDefaults sets the channel variables given to SetDefaults on the
+// channel uuid, with a single uuid_setvar_multi command. It returns an error
+// without sending anything if there are none.
+func (h *Connection) ApplyDefaults(uuid string) (*Event, error) {
+	if err := checkWords(uuid); err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	vars := make([]string, 0, len(h.defaults))
+	for name, value := range h.defaults {
+		vars = append(vars, name+"="+value)
+	}
+	h.mu.Unlock()
+	if len(vars) == 0 {
+		return nil, errNoDefaults
+	}
+	sort.Strings(vars)
+	return h.sendAPI("uuid_setvar_multi", uuid, strings.Join(vars, ";"))
+}
+
+// AnswerUUID answers the channel uuid. Unlike Execute("answer", "", false),
+// it works for any channel from an inbound connection.
+//
+// A -ERR reply, e.g. for a channel that no longer exists, is returned as a
+// *CommandError.
+func (h *Connection) AnswerUUID(uuid string) (*Event, error) {
+	if err := checkWords(uuid); err != nil {
+		return nil, err
+	}
+	return h.sendAPI("uuid_answer", uuid)
+}
+
+// EncodeChannelVars returns the {k=v,...} block that sets channel variables
+// on a dial string, e.g. for originate. Keys are sorted, and values with
+// spaces are quoted.
+//
+// When a value contains a comma, the block switches to the ^^ syntax with
+// another delimiter, e.g. {^^:a=1,2:b=3}. Keys and values that can't be
+// encoded, such as values with braces, are rejected.
+//
+// See https://freeswitch.org/confluence/display/FREESWITCH/Channel+Variables
+// for details.
+func EncodeChannelVars(vars map[string]string) (string, error) {
+	if len(vars) == 0 {
+		return "", nil
+	}
+	keys := make([]string, 0, len(vars))
+	for k, v := range vars {
+		if k == "" || strings.ContainsAny(k, "{}[]=,' \t\r\n") {
+			return "", fmt.Errorf("Invalid channel variable name %q", k)
+		}
+		if strings.ContainsAny(v, "{}'\r\n") {
+			return "", fmt.Errorf("Invalid channel variable value %q for %s", v, k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	delim := ","
+	for _, k := range keys {
+		if strings.Contains(vars[k], ",") {
+			delim = ""
+			break
+		}
+	}
+	if delim == "" {
+		for _, d := range []string{":", ";", "|", "!", "#"} {
+			if !containsAny(vars, d) {
+				delim = d
+				break
+			}
+		}
+		if delim == "" {
+			return "", errors.New("No delimiter available for channel variables")
+		}
+	}
+	b := new(bytes.Buffer)
+	b.WriteString("{")
+	if delim != "," {
+		b.WriteString("^^" + delim)
+	}
+	for n, k := range keys {
+		if n > 0 {
+			b.WriteString(delim)
+		}
+		v := vars[k]
+		if strings.ContainsAny(v, " \t") {
+			v = "'" + v + "'"
+		}
+		b.WriteString(k + "=" + v)
+	}
+	b.WriteString("}")
+	return b.String(), nil
+}
+
+// containsAny returns true if any of the keys or values of m contains s.
+func containsAny(m map[string]string, s string) bool {
+	for k, v := range m {
+		if strings.Contains(k, s) || strings.Contains(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetDTMFPassthrough sets whether DTMF is passed across the bridge of the
+// channel uuid, by setting bridge_filter_dtmf. It must be called before the
+// bridge is established.
+func (h *Connection) SetDTMFPassthrough(uuid string, on bool) (*Event, error) {
+	return h.SetVar(uuid, "bridge_filter_dtmf", strconv.FormatBool(!on))
+}
+
+// Resume tells FreeSWITCH to resume the dialplan when the outbound
+// connection is closed, rather than hanging up the channel.
+//
+// See https://freeswitch.org/confluence/display/FREESWITCH/mod_event_socket#resume
+// for details.
+func (h *Connection) Resume() (*Event, error) {
+	return h.Send("resume")
+}
+
+// ConferenceMember is a member of a conference, as listed by ConferenceList.
+type ConferenceMember struct {
+	MemberID     int
+	Channel      string // e.g. sofia/internal/1000@example.com
+	UUID         string
+	CallerIDName string
+	CallerIDNum  string
+	Flags        []string // e.g. hear, speak, talking, floor, moderator
+	Muted        bool     // Can't speak
+	Deaf         bool     // Can't hear
+	Talking      bool
+	Floor        bool
+	Moderator    bool
+}
+
+// ConferenceList returns the members of the conference name.
+func (h *Connection) ConferenceList(name string) ([]ConferenceMember, error) {
+	if err := checkWords(name); err != nil {
+		return nil, err
+	}
+	ev, err := h.sendAPI("conference", name, "list")
+	if err != nil {
+		return nil, err
+	}
+	var members []ConferenceMember
+	for _, line := range strings.Split(strings.TrimSpace(ev.Body), "\n") {
+		if line == "" {
+			continue
+		}
+		f := strings.Split(line, ";")
+		if len(f) < 6 {
+			return nil, fmt.Errorf("Unexpected conference list line: %q", line)
+		}
+		id, err := strconv.Atoi(f[0])
+		if err != nil {
+			return nil, err
+		}
+		m := ConferenceMember{
+			MemberID:     id,
+			Channel:      f[1],
+			UUID:         f[2],
+			CallerIDName: f[3],
+			CallerIDNum:  f[4],
+			Flags:        strings.Split(f[5], "|"),
+			Muted:        true,
+			Deaf:         true,
+		}
+		for _, flag := range m.Flags {
+			switch flag {
+			case "hear":
+				m.Deaf = false
+			case "speak":
+				m.Muted = false
+			case "talking":
+				m.Talking = true
+			case "floor":
+				m.Floor = true
+			case "moderator":
+				m.Moderator = true
+			}
+		}
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+// HupAll hangs up all channels with cause, e.g. MANAGER_REQUEST. If varName
+// is set, only the channels whose variable varName is varValue are hung up.
+//
+// Example:
+//
+//	HupAll("NORMAL_CLEARING", "", "")                    // all calls!
+//	HupAll("MANAGER_REQUEST", "sip_gateway_name", "gw1") // calls through gw1
+func (h *Connection) HupAll(cause, varName, varValue string) (*Event, error) {
+	if err := checkCause(cause); err != nil {
+		return nil, err
+	}
+	if varName == "" {
+		if varValue != "" {
+			return nil, errInvalidArg
+		}
+		return h.sendAPI("hupall", cause)
+	}
+	if err := checkWords(varName, varValue); err != nil {
+		return nil, err
+	}
+	return h.sendAPI("hupall", cause, varName, varValue)
+}
+
+// checkCause returns an error unless cause looks like a hangup cause, e.g.
+// NORMAL_CLEARING.
+func checkCause(cause string) error {
+	if cause == "" {
+		return errInvalidArg
+	}
+	for _, c := range cause {
+		if (c < 'A' || c > 'Z') && c != '_' {
+			return fmt.Errorf("Invalid hangup cause %q", cause)
+		}
+	}
+	return nil
+}
+
+// MaxSessions returns the maximum number of sessions of the server, from
+// fsctl max_sessions.
+func (h *Connection) MaxSessions() (int, error) {
+	ev, err := h.sendAPI("fsctl", "max_sessions")
+	if err != nil {
+		return 0, err
+	}
+	// +OK max sessions: 1000
+	body := strings.TrimSpace(ev.Body)
+	n, err := strconv.Atoi(strings.TrimSpace(body[strings.LastIndex(body, ":")+1:]))
+	if err != nil {
+		return 0, fmt.Errorf("Unexpected fsctl max_sessions reply %q", body)
+	}
+	return n, nil
+}
+
+// Sessions returns the number of sessions currently up on the server, from
+// the status command.
+func (h *Connection) Sessions() (int, error) {
+	ev, err := h.sendAPI("status")
+	if err != nil {
+		return 0, err
+	}
+	// 3 session(s) - peak 10, last 5min 4
+	for _, line := range strings.Split(ev.Body, "\n") {
+		if n := strings.Index(line, " session(s)"); n > 0 {
+			return strconv.Atoi(strings.TrimSpace(line[:n]))
+		}
+	}
+	return 0, fmt.Errorf("Unexpected status reply %q", ev.Body)
+}
+
+// CanAcceptCall reports whether the server is below its maximum number of
+// sessions, for admission control before sending it a new call.
+func (h *Connection) CanAcceptCall() (bool, error) {
+	max, err := h.MaxSessions()
+	if err != nil {
+		return false, err
+	}
+	n, err := h.Sessions()
+	if err != nil {
+		return false, err
+	}
+	return n < max, nil
+}
+
+// Shutdown shuts FreeSWITCH down with fsctl. The mode is one of "elegant"
+// to wait for all calls to end, "asap" to wait for them without accepting
+// new ones, or "restart" to restart instead. Any other mode, including "",
+// is rejected without sending anything.
+func (h *Connection) Shutdown(mode string) (*Event, error) {
+	switch mode {
+	case "elegant", "asap", "restart":
+		return h.sendAPI("fsctl", "shutdown", mode)
+	}
+	return nil, fmt.Errorf("Invalid shutdown mode %q", mode)
+}
+
+// Filter adds a filter so that only events whose header matches value are
+// received, e.g. Filter("Unique-ID", uuid).
+//
+// See https://freeswitch.org/confluence/display/FREESWITCH/mod_event_socket#filter
+// for details.
+func (h *Connection) Filter(header, value string) (*Event, error) {
+	if err := checkWords(header); err != nil {
+		return nil, err
+	}
+	if err := checkArgs(value); err != nil {
+		return nil, err
+	}
+	return h.Send("filter " + header + " " + value)
+}
+
+// FilterDelete removes a filter added by Filter.
+func (h *Connection) FilterDelete(header, value string) (*Event, error) {
+	if err := checkWords(header); err != nil {
+		return nil, err
+	}
+	if err := checkArgs(value); err != nil {
+		return nil, err
+	}
+	return h.Send("filter delete " + header + " " + value)
+}
+
+// SubscribeFiltered adds filters then subscribes to events in format, which
+// is one of plain, json or xml. If any step fails, the filters added so far
+// are deleted so the connection is left as it was.
+//
+// Example:
+//
+//	SubscribeFiltered("json", map[string]string{"Unique-ID": uuid},
+//		"CHANNEL_ANSWER", "CHANNEL_HANGUP")
+func (h *Connection) SubscribeFiltered(format string, filters map[string]string, events ...string) error {
+	switch format {
+	case "plain", "json", "xml":
+	default:
+		return fmt.Errorf("Invalid event format %q", format)
+	}
+	if err := checkWords(events...); err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return errInvalidArg
+	}
+	headers := make([]string, 0, len(filters))
+	for k := range filters {
+		headers = append(headers, k)
+	}
+	sort.Strings(headers)
+	var err error
+	n := 0
+	for ; n < len(headers); n++ {
+		if _, err = h.Filter(headers[n], filters[headers[n]]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		_, err = h.Send("events " + format + " " + strings.Join(events, " "))
+		if err == nil {
+			h.addSubscriptions(events)
+			return nil
+		}
+	}
+	for _, k := range headers[:n] {
+		h.FilterDelete(k, filters[k])
+	}
+	return err
+}
+
+// Media reinvites the channel uuid so that its media flows through
+// FreeSWITCH when on is set, or directly between the endpoints (bypass
+// media) otherwise.
+func (h *Connection) Media(uuid string, on bool) (*Event, error) {
+	if err := checkWords(uuid); err != nil {
+		return nil, err
+	}
+	if on {
+		return h.sendAPI("uuid_media", uuid)
+	}
+	return h.sendAPI("uuid_media", "off", uuid)
+}
+
+// Chat sends message from one address to another over a chat protocol,
+// e.g. Chat("sip", "1000@example.com", "1001@example.com", "hello there").
+//
+// The arguments are separated by | on the wire, so none of them may
+// contain it.
+//
+// See https://freeswitch.org/confluence/display/FREESWITCH/mod_sms
+// for details.
+func (h *Connection) Chat(proto, from, to, message string) (*Event, error) {
+	if err := checkWords(proto, from, to); err != nil {
+		return nil, err
+	}
+	args := []string{proto, from, to, message}
+	for _, arg := range args {
+		if strings.Contains(arg, "|") {
+			return nil, errInvalidArg
+		}
+	}
+	return h.sendAPI("chat", strings.Join(args, "|"))
+}
+
+// Deflect redirects the answered channel uuid to uri with a SIP REFER, e.g.
+// Deflect(uuid, "sip:1001@example.com"). A -ERR reply is returned as a
+// *CommandError.
+func (h *Connection) Deflect(uuid, uri string) (*Event, error) {
+	if err := checkWords(uuid, uri); err != nil {
+		return nil, err
+	}
+	return h.sendAPI("uuid_deflect", uuid, uri)
+}
+
+// checkModule returns an error unless name looks like a module name, e.g.
+// mod_sofia.
+func checkModule(name string) error {
+	if name == "" {
+		return errInvalidArg
+	}
+	for _, c := range name {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '_' {
+			return fmt.Errorf("Invalid module name %q", name)
+		}
+	}
+	return nil
+}
+
+// LoadModule loads the module name, e.g. mod_sofia. A -ERR reply, e.g. for
+// a module that doesn't exist, is returned as a *CommandError.
+func (h *Connection) LoadModule(name string) (*Event, error) {
+	if err := checkModule(name); err != nil {
+		return nil, err
+	}
+	return h.sendAPI("load", name)
+}
+
+// UnloadModule unloads the module name.
+func (h *Connection) UnloadModule(name string) (*Event, error) {
+	if err := checkModule(name); err != nil {
+		return nil, err
+	}
+	return h.sendAPI("unload", name)
+}
+
+// ReloadModule unloads and loads the module name again.
+func (h *Connection) ReloadModule(name string) (*Event, error) {
+	if err := checkModule(name); err != nil {
+		return nil, err
+	}
+	return h.sendAPI("reload", name)
+}
+
+// RecoveryRefresh tells the sofia profile to recover the calls stored in the
+// recovery database, e.g. after failing over from another FreeSWITCH. There
+// is no recovery_refresh api command: profiles recover with sofia profile
+// <profile> recover, while uuid_recovery_refresh works on a single channel.
+//
+// See https://freeswitch.org/confluence/display/FREESWITCH/Sofia+Recover
+// for details.
+func (h *Connection) RecoveryRefresh(profile string) (*Event, error) {
+	if err := checkWords(profile); err != nil {
+		return nil, err
+	}
+	return h.sendAPI("sofia", "profile", profile, "recover")
+}
+
+// SendDTMFTimed sends the DTMF digits to the channel uuid, each lasting
+// duration, with gap between them. FreeSWITCH pauses by steps of 500ms, so
+// gap is rounded down to a multiple of it, adding to the usual inter-digit
+// silence.
+//
+// Example, "12" with 100ms digits and a 1s gap is sent as 1@100+W+2@100.
+func (h *Connection) SendDTMFTimed(uuid, digits string, duration, gap time.Duration) (*Event, error) {
+	if err := checkWords(uuid, digits); err != nil {
+		return nil, err
+	}
+	ms := int(duration / time.Millisecond)
+	if ms <= 0 || gap < 0 {
+		return nil, errInvalidArg
+	}
+	// W pauses for 1s, w for 500ms.
+	n := int(gap / (500 * time.Millisecond))
+	pause := strings.Repeat("W", n/2) + strings.Repeat("w", n%2)
+	seq := make([]string, 0, 2*len(digits))
+	for i, d := range digits {
+		if !strings.ContainsRune("0123456789ABCDabcd*#", d) {
+			return nil, fmt.Errorf("Invalid DTMF digit %q", d)
+		}
+		if i > 0 && pause != "" {
+			seq = append(seq, pause)
+		}
+		seq = append(seq, string(d)+"@"+strconv.Itoa(ms))
+	}
+	return h.sendAPI("uuid_send_dtmf", uuid, strings.Join(seq, "+"))
+}
+
+// PhoneEvent sends the phone event, talk or hold, to the endpoint of the
+// channel uuid, e.g. to update the hold indication of a SIP phone.
+func (h *Connection) PhoneEvent(uuid, event string) (*Event, error) {
+	if err := checkWords(uuid); err != nil {
+		return nil, err
+	}
+	switch event {
+	case "talk", "hold":
+	default:
+		return nil, fmt.Errorf("Invalid phone event %q", event)
+	}
+	return h.sendAPI("uuid_phone_event", uuid, event)
+}
+
+// DualTransfer transfers both legs of the bridged call uuid at once, the
+// leg uuid to destA and the other leg to destB. Destinations are extensions
+// with an optional dialplan and context, as in 1000/XML/default.
+func (h *Connection) DualTransfer(uuid, destA, destB string) (*Event, error) {
+	if err := checkWords(uuid, destA, destB); err != nil {
+		return nil, err
+	}
+	return h.sendAPI("uuid_dual_transfer", uuid, destA, destB)
+}
+
+// JitterBuffer sets the jitter buffer of the channel uuid according to
+// spec: its length in ms, optionally followed by its maximum length and
+// maximum drift, as in 60:200:40. A spec of 0 or off disables it, and pause
+// or resume pause and resume it.
+func (h *Connection) JitterBuffer(uuid, spec string) (*Event, error) {
+	if err := checkWords(uuid); err != nil {
+		return nil, err
+	}
+	switch spec {
+	case "off", "pause", "resume":
+	default:
+		f := strings.Split(spec, ":")
+		if len(f) > 3 {
+			return nil, fmt.Errorf("Invalid jitter buffer spec %q", spec)
+		}
+		for _, v := range f {
+			if n, err := strconv.Atoi(v); err != nil || n < 0 {
+				return nil, fmt.Errorf("Invalid jitter buffer spec %q", spec)
+			}
+		}
+	}
+	return h.sendAPI("uuid_jitterbuffer", uuid, spec)
+}
+
+// FlushDTMF discards the DTMF digits buffered on the channel uuid, e.g.
+// before collecting new ones.
+func (h *Connection) FlushDTMF(uuid string) (*Event, error) {
+	if err := checkWords(uuid); err != nil {
+		return nil, err
+	}
+	return h.sendAPI("uuid_flush_dtmf", uuid)
+}
+
+// RecordSession is a recording started by RecordStart.
+type RecordSession struct {
+	h    *Connection
+	UUID string
+	Path string
+	stop chan *Event
+}
+
+// RecordStart starts recording the channel uuid to path, and returns a
+// RecordSession to wait for the end of the recording.
+//
+// The connection must be subscribed to RECORD_STOP events. The RECORD_STOP
+// event of the recording is delivered to RecordSession.Wait instead of
+// ReadEvent, so concurrent recordings of the same call each get their own.
+func (h *Connection) RecordStart(uuid, path string) (*RecordSession, error) {
+	if err := checkWords(uuid, path); err != nil {
+		return nil, err
+	}
+	rs := &RecordSession{h: h, UUID: uuid, Path: path, stop: make(chan *Event, 1)}
+	// Register first, the recording might stop before the reply is read.
+	h.mu.Lock()
+	if _, exists := h.recordings[path]; exists {
+		h.mu.Unlock()
+		return nil, fmt.Errorf("Recording to %s already in progress", path)
+	}
+	if h.recordings == nil {
+		h.recordings = make(map[string]chan *Event)
+	}
+	h.recordings[path] = rs.stop
+	h.mu.Unlock()
+	if _, err := h.sendAPI("uuid_record", uuid, "start", path); err != nil {
+		h.mu.Lock()
+		delete(h.recordings, path)
+		h.mu.Unlock()
+		return nil, err
+	}
+	return rs, nil
+}
+
+// Stop stops the recording. Wait returns once it's actually stopped.
+func (rs *RecordSession) Stop() (*Event, error) {
+	return rs.h.sendAPI("uuid_record", rs.UUID, "stop", rs.Path)
+}
+
+// Wait waits for the RECORD_STOP event of the recording and returns its
+// information, or an error when ctx is done or the connection is closed.
+func (rs *RecordSession) Wait(ctx context.Context) (*RecordingInfo, error) {
+	select {
+	case ev, ok := <-rs.stop:
+		if !ok {
+			return nil, errClosed
+		}
+		return ev.Recording()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// deliverRecording sends a RECORD_STOP event to the RecordSession of its
+// path, if any, and returns true if the event was taken.
+func (h *Connection) deliverRecording(ev *Event) bool {
+	if ev.Name() != "RECORD_STOP" {
+		return false
+	}
+	path := ev.Get("Record-File-Path")
+	h.mu.Lock()
+	stop, ok := h.recordings[path]
+	delete(h.recordings, path)
+	h.mu.Unlock()
+	if ok {
+		stop <- ev
+	}
+	return ok
+}
+
+// LogLevel is a FreeSWITCH log level, as taken by the log command.
+type LogLevel int
+
+// Log levels, from the least to the most verbose.
+const (
+	LogLevelConsole LogLevel = iota
+	LogLevelAlert
+	LogLevelCrit
+	LogLevelErr
+	LogLevelWarning
+	LogLevelNotice
+	LogLevelInfo
+	LogLevelDebug
+)
+
+// Log enables log/data frames up to level on the connection. They're read
+// with ReadEvent like events, with the log line as body and headers such as
+// Log-Level and Log-File.
+func (h *Connection) Log(level LogLevel) (*Event, error) {
+	if level < LogLevelConsole || level > LogLevelDebug {
+		return nil, fmt.Errorf("Invalid log level %d", level)
+	}
+	return h.Send("log " + strconv.Itoa(int(level)))
+}
+
+// SubscribeEvents subscribes to events in format, which is one of plain, json
+// or xml. Events already subscribed to with SubscribeEvents or
+// SubscribeFiltered are skipped, so subscribing twice doesn't deliver events
+// twice; no command is sent if all of them are.
+//
+// As with the events command, names following CUSTOM are subclasses, e.g.
+// SubscribeEvents("json", "CHANNEL_ANSWER", "CUSTOM", "sofia::register").
+// Subclasses are case sensitive, event names are not.
+func (h *Connection) SubscribeEvents(format string, events ...string) error {
+	switch format {
+	case "plain", "json", "xml":
+	default:
+		return fmt.Errorf("Invalid event format %q", format)
+	}
+	if err := checkWords(events...); err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return errInvalidArg
+	}
+	// Checking, sending and recording the subscriptions must happen
+	// atomically, otherwise concurrent calls could send the same events.
+	h.submu.Lock()
+	defer h.submu.Unlock()
+	names, subclasses := splitSubscriptions(events)
+	sameFormat := h.EventFormat() == format
+	h.mu.Lock()
+	all := sameFormat && h.subscriptions["ALL"]
+	var add, addSubclasses []string
+	for _, e := range names {
+		if all || (sameFormat && h.subscriptions[strings.ToUpper(e)]) {
+			continue
+		}
+		add = append(add, e)
+	}
+	for _, e := range subclasses {
+		if all || (sameFormat && h.subclasses[e]) {
+			continue
+		}
+		addSubclasses = append(addSubclasses, e)
+	}
+	h.mu.Unlock()
+	if len(addSubclasses) > 0 {
+		// Subclasses must follow CUSTOM, even if it was sent before.
+		for n, e := range add {
+			if strings.EqualFold(e, "CUSTOM") {
+				add = append(add[:n], add[n+1:]...)
+				break
+			}
+		}
+		add = append(append(add, "CUSTOM"), addSubclasses...)
+	}
+	if len(add) == 0 {
+		return nil
+	}
+	if _, err := h.Send("events " + format + " " + strings.Join(add, " ")); err != nil {
+		return err
+	}
+	h.addSubscriptions(add)
+	return nil
+}
+
+// splitSubscriptions splits the arguments of the events command into event
+// names and the CUSTOM subclasses that follow CUSTOM. CUSTOM itself is an
+// event name.
+func splitSubscriptions(events []string) (names, subclasses []string) {
+	for n, e := range events {
+		names = append(names, e)
+		if strings.EqualFold(e, "CUSTOM") {
+			return names, events[n+1:]
+		}
+	}
+	return names, nil
+}
+
+// Subscriptions returns the sorted names of the events and CUSTOM subclasses
+// subscribed to with SubscribeEvents or SubscribeFiltered, minus those
+// removed since with nixevent or noevents. Event names are upper case,
+// subclasses are as given.
+func (h *Connection) Subscriptions() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	events := make([]string, 0, len(h.subscriptions)+len(h.subclasses))
+	for e := range h.subscriptions {
+		events = append(events, e)
+	}
+	for e := range h.subclasses {
+		events = append(events, e)
+	}
+	sort.Strings(events)
+	return events
+}
+
+// addSubscriptions records events, the arguments of an events command, as
+// subscribed to.
+func (h *Connection) addSubscriptions(events []string) {
+	names, subclasses := splitSubscriptions(events)
+	h.mu.Lock()
+	if h.subscriptions == nil {
+		h.subscriptions = make(map[string]bool)
+	}
+	for _, e := range names {
+		h.subscriptions[strings.ToUpper(e)] = true
+	}
+	if len(subclasses) > 0 && h.subclasses == nil {
+		h.subclasses = make(map[string]bool)
+	}
+	for _, e := range subclasses {
+		h.subclasses[e] = true
+	}
+	h.mu.Unlock()
+}
+
+// trackSubscriptions forgets the subscriptions removed by command, if it's a
+// nixevent or noevents command accepted by the server.
+func (h *Connection) trackSubscriptions(command string) {
+	f := strings.Fields(command)
+	if len(f) == 0 {
+		return
+	}
+	switch strings.ToLower(f[0]) {
+	case "noevents":
+		h.mu.Lock()
+		h.subscriptions, h.subclasses = nil, nil
+		h.mu.Unlock()
+	case "nixevent":
+		names, subclasses := splitSubscriptions(f[1:])
+		h.mu.Lock()
+		// ALL doesn't cover everything anymore.
+		delete(h.subscriptions, "ALL")
+		for _, e := range names {
+			if strings.EqualFold(e, "CUSTOM") && len(subclasses) > 0 {
+				// Only the subclasses are removed.
+				continue
+			}
+			delete(h.subscriptions, strings.ToUpper(e))
+		}
+		for _, e := range subclasses {
+			delete(h.subclasses, e)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// UUIDExists reports whether the channel uuid exists on the server.
+func (h *Connection) UUIDExists(uuid string) (bool, error) {
+	if err := checkWords(uuid); err != nil {
+		return false, err
+	}
+	ev, err := h.sendAPI("uuid_exists", uuid)
+	if err != nil {
+		return false, err
+	}
+	switch body := strings.TrimSpace(ev.Body); body {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	default:
+		return false, fmt.Errorf("Unexpected uuid_exists reply %q", body)
+	}
+}
+
+// BgAPIWithJobUUID runs command in the background with bgapi, using jobUUID
+// as its Job-UUID so callers control the correlation key of the job. The
+// BACKGROUND_JOB event with the result is delivered to the returned channel
+// instead of ReadEvent.
+//
+// The connection must be subscribed to BACKGROUND_JOB events, or the
+// channel never receives anything. The channel is closed if the connection
+// is closed before the job completes.
+//
+// Example:
+//
+//	job, err := c.BgAPIWithJobUUID("originate user/1000 &park()", id)
+//	...
+//	ev := <-job
+//	fmt.Println(ev.Body)
+func (h *Connection) BgAPIWithJobUUID(command, jobUUID string) (<-chan *Event, error) {
+	if err := checkWords(jobUUID); err != nil {
+		return nil, err
+	}
+	if command == "" {
+		return nil, errInvalidArg
+	}
+	if err := checkArgs(command); err != nil {
+		return nil, err
+	}
+	job := make(chan *Event, 1)
+	// Register first, the job might complete before the reply is read.
+	h.mu.Lock()
+	if _, exists := h.jobs[jobUUID]; exists {
+		h.mu.Unlock()
+		return nil, fmt.Errorf("Job %s already in progress", jobUUID)
+	}
+	if h.jobs == nil {
+		h.jobs = make(map[string]chan *Event)
+	}
+	h.jobs[jobUUID] = job
+	h.mu.Unlock()
+	cmd := "bgapi " + command
+	start := time.Now()
+	w, err := h.writeCommand(cmd, []byte(cmd+"\nJob-UUID: "+jobUUID+"\n\n"), false)
+	if err == nil {
+		_, err = h.readReplyTimeout(w.ev, w.err)
+	}
+	h.audit(cmd, time.Since(start), err)
+	if err != nil {
+		h.mu.Lock()
+		delete(h.jobs, jobUUID)
+		h.mu.Unlock()
+		return nil, err
+	}
+	return job, nil
+}
+
+// deliverJob sends a BACKGROUND_JOB event to the channel returned by
+// BgAPIWithJobUUID for its Job-UUID, if any, and returns true if the event
+// was taken.
+func (h *Connection) deliverJob(ev *Event) bool {
+	if ev.Name() != "BACKGROUND_JOB" {
+		return false
+	}
+	id := ev.Get("Job-Uuid")
+	h.mu.Lock()
+	job, ok := h.jobs[id]
+	delete(h.jobs, id)
+	h.mu.Unlock()
+	if ok {
+		job <- ev
+	}
+	return ok
+}
+
+// forgetJob stops waiting for the result of the job jobUUID of
+// BgAPIWithJobUUID, if it's still pending.
+func (h *Connection) forgetJob(jobUUID string) {
+	h.mu.Lock()
+	delete(h.jobs, jobUUID)
+	h.mu.Unlock()
+}
+
+// GatewayInfo is the status of a sofia gateway, as listed by GatewayStatus.
+type GatewayInfo struct {
+	Profile  string
+	Name     string
+	Data     string        // e.g. sip:gw1@example.com
+	State    string        // Registration state, e.g. REGED or NOREG
+	Status   string        // UP or DOWN, if reported by the server
+	PingTime time.Duration // Zero if pings are disabled
+}
+
+// GatewayStatus returns the status of the gateways of the sofia profile, or
+// of all gateways if profile is empty, from sofia status gateway.
+func (h *Connection) GatewayStatus(profile string) ([]GatewayInfo, error) {
+	if profile != "" {
+		if err := checkWords(profile); err != nil {
+			return nil, err
+		}
+	}
+	ev, err := h.sendAPI("sofia", "status", "gateway")
+	if err != nil {
+		return nil, err
+	}
+	// A tab separated table, with a header line and lines of = around the
+	// rows, followed by a summary line.
+	var (
+		cols     map[string]int
+		gateways []GatewayInfo
+	)
+	for _, line := range strings.Split(ev.Body, "\n") {
+		f := strings.Split(line, "\t")
+		for i := range f {
+			f[i] = strings.TrimSpace(f[i])
+		}
+		if cols == nil {
+			if len(f) > 1 && strings.HasPrefix(f[0], "Profile::") {
+				cols = make(map[string]int, len(f))
+				for i, name := range f {
+					cols[name] = i
+				}
+			}
+			continue
+		}
+		if len(f) < 2 {
+			continue
+		}
+		get := func(name string) string {
+			if i, ok := cols[name]; ok && i < len(f) {
+				return f[i]
+			}
+			return ""
+		}
+		n := strings.Index(f[0], "::")
+		if n < 0 {
+			continue
+		}
+		gw := GatewayInfo{
+			Profile: f[0][:n],
+			Name:    f[0][n+2:],
+			Data:    get("Data"),
+			State:   get("State"),
+			Status:  get("Status"),
+		}
+		if profile != "" && gw.Profile != profile {
+			continue
+		}
+		if v := get("Ping Time"); v != "" {
+			ms, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid ping time %q for gateway %s", v, gw.Name)
+			}
+			gw.PingTime = time.Duration(ms * float64(time.Millisecond))
+		}
+		gateways = append(gateways, gw)
+	}
+	if cols == nil {
+		return nil, fmt.Errorf("Unexpected sofia status gateway reply %q", ev.Body)
+	}
+	return gateways, nil
+}
+
+// EventsForUUID returns a channel receiving the events of the channel uuid,
+// by Unique-ID, instead of ReadEvent. Other events are still read with
+// ReadEvent. Calling it again for the same uuid returns the same channel.
+//
+// The channel is never closed; call StopEventsForUUID when done with it.
+// As with Server.Adopt, it buffers up to 1024 events, and when it's full new
+// events for uuid are dropped, so a slow reader can't stall the connection.
+// DroppedEventsForUUID returns how many were.
+func (h *Connection) EventsForUUID(uuid string) <-chan *Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if a, exists := h.uuidEvents[uuid]; exists {
+		return a.ev
+	}
+	if h.uuidEvents == nil {
+		h.uuidEvents = make(map[string]*adoption)
+	}
+	a := newAdoption()
+	h.uuidEvents[uuid] = a
+	return a.ev
+}
+
+// DroppedEventsForUUID returns the number of events of uuid dropped so far
+// because the channel returned by EventsForUUID was full.
+func (h *Connection) DroppedEventsForUUID(uuid string) int64 {
+	h.mu.Lock()
+	a := h.uuidEvents[uuid]
+	h.mu.Unlock()
+	if a == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&a.dropped)
+}
+
+// StopEventsForUUID stops delivering the events of uuid to the channel
+// returned by EventsForUUID. Subsequent events go back to ReadEvent.
+func (h *Connection) StopEventsForUUID(uuid string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if a, exists := h.uuidEvents[uuid]; exists {
+		close(a.done)
+		delete(h.uuidEvents, uuid)
+	}
+}
+
+// deliverUUID queues ev on the channel returned by EventsForUUID for its
+// UUID, if any, and returns true if the event was taken, even if dropped. It
+// never blocks.
+func (h *Connection) deliverUUID(ev *Event) bool {
+	uuid := ev.UniqueID()
+	if uuid == "" {
+		return false
+	}
+	h.mu.Lock()
+	a := h.uuidEvents[uuid]
+	h.mu.Unlock()
+	if a == nil {
+		return false
+	}
+	return a.send(ev)
+}
@@ -0,0 +1,913 @@
+// Copyright 2013 Alexandre Fiori
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package eventsocket
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEval(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("hello\n"))
+	v, err := h.Eval("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "hello" {
+		t.Errorf("Eval returned %q, want hello", v)
+	}
+	if cmd := command(t, cmds); cmd != "api eval hello" {
+		t.Errorf("Sent %q", cmd)
+	}
+}
+
+func TestSessionGetVar(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(commandReply("1000"), commandReply(""))
+	v, err := h.SessionGetVar("caller_id_number")
+	if err != nil || v != "1000" {
+		t.Errorf("SessionGetVar returned %q, %v", v, err)
+	}
+	if cmd := command(t, cmds); cmd != "getvar caller_id_number" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if v, err = h.SessionGetVar("unset"); err != nil || v != "" {
+		t.Errorf("SessionGetVar of an unset variable returned %q, %v", v, err)
+	}
+}
+
+func TestConferenceRecord(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("+OK\n"), apiResponse("+OK\n"))
+	if _, err := h.ConferenceRecord("3000", "/tmp/3000.wav"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api conference 3000 record /tmp/3000.wav" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if _, err := h.ConferenceStopRecord("3000", "all"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api conference 3000 norecord all" {
+		t.Errorf("Sent %q", cmd)
+	}
+	for _, path := range []string{"a\nb", "/tmp/a.wav all", ""} {
+		if _, err := h.ConferenceRecord("3000", path); err != errInvalidArg {
+			t.Errorf("ConferenceRecord to %q returned %v", path, err)
+		}
+	}
+	if _, err := h.ConferenceStopRecord("3000 kick", "all"); err != errInvalidArg {
+		t.Errorf("ConferenceStopRecord with a space returned %v", err)
+	}
+}
+
+func TestShowScheduledTasks(t *testing.T) {
+	h, s := newTestConn(t)
+	rows := `{"row_count":1,"rows":[{"task_id":"3","task_desc":"hangup",` +
+		`"task_group":"abc","task_runtime":"1357139045","hostname":"fs1"}]}`
+	cmds := s.reply(apiResponse(rows), apiResponse("+OK\n"))
+	tasks, err := h.ShowScheduledTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api show tasks as json" {
+		t.Errorf("Sent %q", cmd)
+	}
+	want := ScheduledTask{ID: 3, Description: "hangup", Group: "abc",
+		Runtime: time.Unix(1357139045, 0), Hostname: "fs1"}
+	if len(tasks) != 1 || tasks[0] != want {
+		t.Errorf("ShowScheduledTasks returned %+v, want %+v", tasks, want)
+	}
+	if _, err = h.SchedDel("3"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api sched_del 3" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if _, err = h.SchedDel("3 4"); err != errInvalidArg {
+		t.Errorf("SchedDel with a space returned %v", err)
+	}
+}
+
+func TestSetVar(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("+OK\n"), apiResponse("+OK\n"))
+	if _, err := h.SetVar("abc", "foo", "bar baz"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api uuid_setvar abc foo bar baz" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if _, err := h.SetVar("abc", "foo", ""); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api uuid_setvar abc foo" {
+		t.Errorf("Sent %q to unset", cmd)
+	}
+	if _, err := h.SetVar("abc", "foo bar", "x"); err != errInvalidArg {
+		t.Errorf("SetVar with a space in the name returned %v", err)
+	}
+}
+
+func TestAnswerUUID(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("+OK\n"), apiResponse("-ERR No such channel!\n"))
+	if _, err := h.AnswerUUID("abc"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api uuid_answer abc" {
+		t.Errorf("Sent %q", cmd)
+	}
+	_, err := h.AnswerUUID("abc")
+	if cerr, ok := err.(*CommandError); !ok || cerr.Message != "No such channel!" {
+		t.Errorf("AnswerUUID of a missing channel returned %#v", err)
+	}
+}
+
+func TestShowStream(t *testing.T) {
+	h, s := newTestConn(t)
+	s.reply(apiResponse(`{"row_count":3,"rows":[{"reg_user":"1000"},` +
+		`{"reg_user":"1001"},{"reg_user":"1002"}]}`))
+	var users []string
+	err := h.ShowStream("registrations", func(row map[string]string) error {
+		users = append(users, row["reg_user"])
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(users, ",") != "1000,1001,1002" {
+		t.Errorf("ShowStream returned rows %v", users)
+	}
+}
+
+func TestEncodeChannelVars(t *testing.T) {
+	for _, tc := range []struct {
+		vars map[string]string
+		want string
+	}{
+		{nil, ""},
+		{map[string]string{"b": "2", "a": "1"}, "{a=1,b=2}"},
+		{map[string]string{"name": "John Doe"}, "{name='John Doe'}"},
+		{map[string]string{"a": "1,2", "b": "3"}, "{^^:a=1,2:b=3}"},
+		{map[string]string{"a": "1,2", "b": "x:y"}, "{^^;a=1,2;b=x:y}"},
+	} {
+		got, err := EncodeChannelVars(tc.vars)
+		if err != nil || got != tc.want {
+			t.Errorf("EncodeChannelVars(%v) returned %q, %v, want %q", tc.vars, got, err, tc.want)
+		}
+	}
+	for _, vars := range []map[string]string{
+		{"a b": "1"},
+		{"a": "{1}"},
+	} {
+		if _, err := EncodeChannelVars(vars); err == nil {
+			t.Errorf("EncodeChannelVars(%v) returned no error", vars)
+		}
+	}
+}
+
+func TestSetDTMFPassthrough(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("+OK\n"), apiResponse("+OK\n"))
+	if _, err := h.SetDTMFPassthrough("abc", true); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api uuid_setvar abc bridge_filter_dtmf false" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if _, err := h.SetDTMFPassthrough("abc", false); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api uuid_setvar abc bridge_filter_dtmf true" {
+		t.Errorf("Sent %q", cmd)
+	}
+}
+
+func TestResume(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(commandReply("+OK"))
+	if _, err := h.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "resume" {
+		t.Errorf("Sent %q", cmd)
+	}
+}
+
+func TestConferenceList(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse(
+		"1;sofia/internal/1000@example.com;abc;Alice;1000;hear|speak|talking|floor;0;0;0;0\n" +
+			"2;sofia/internal/1001@example.com;def;Bob;1001;hear|moderator;0;0;0;0\n"))
+	members, err := h.ConferenceList("3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api conference 3000 list" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if len(members) != 2 {
+		t.Fatalf("ConferenceList returned %d members", len(members))
+	}
+	a, b := members[0], members[1]
+	if a.MemberID != 1 || a.UUID != "abc" || a.CallerIDName != "Alice" ||
+		a.Muted || a.Deaf || !a.Talking || !a.Floor || a.Moderator {
+		t.Errorf("First member is %+v", a)
+	}
+	if b.MemberID != 2 || b.Channel != "sofia/internal/1001@example.com" ||
+		b.CallerIDNum != "1001" || !b.Muted || b.Deaf || !b.Moderator {
+		t.Errorf("Second member is %+v", b)
+	}
+}
+
+func TestHupAll(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("+OK\n"), apiResponse("+OK\n"))
+	if _, err := h.HupAll("MANAGER_REQUEST", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api hupall MANAGER_REQUEST" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if _, err := h.HupAll("NORMAL_CLEARING", "sip_gateway_name", "gw1"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api hupall NORMAL_CLEARING sip_gateway_name gw1" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if _, err := h.HupAll("normal clearing", "", ""); err == nil {
+		t.Error("HupAll with an invalid cause returned no error")
+	}
+	if _, err := h.HupAll("NORMAL_CLEARING", "", "gw1"); err != errInvalidArg {
+		t.Errorf("HupAll with a value and no variable returned %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("+OK\n"), apiResponse("+OK\n"))
+	for _, mode := range []string{"", "now", "cancel", "graceful", "asap asap", "elegant\n"} {
+		if _, err := h.Shutdown(mode); err == nil {
+			t.Errorf("Shutdown(%q) returned no error", mode)
+		}
+	}
+	if _, err := h.Shutdown("elegant"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api fsctl shutdown elegant" {
+		t.Errorf("Sent %q, want the first command to be the valid one", cmd)
+	}
+	if _, err := h.Shutdown("restart"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api fsctl shutdown restart" {
+		t.Errorf("Sent %q", cmd)
+	}
+}
+
+func TestSubscribeFilteredRollback(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(commandReply("+OK filter added."), commandReply("+OK filter added."),
+		commandReply("-ERR invalid event"),
+		commandReply("+OK filter deleted."), commandReply("+OK filter deleted."))
+	err := h.SubscribeFiltered("json", map[string]string{
+		"Unique-ID":      "abc",
+		"Call-Direction": "inbound",
+	}, "NO_SUCH_EVENT")
+	if _, ok := err.(*CommandError); !ok {
+		t.Errorf("SubscribeFiltered returned %v", err)
+	}
+	for _, want := range []string{
+		"filter Call-Direction inbound",
+		"filter Unique-ID abc",
+		"events json NO_SUCH_EVENT",
+		"filter delete Call-Direction inbound",
+		"filter delete Unique-ID abc",
+	} {
+		if cmd := command(t, cmds); cmd != want {
+			t.Errorf("Sent %q, want %q", cmd, want)
+		}
+	}
+	if subs := h.Subscriptions(); len(subs) != 0 {
+		t.Errorf("Subscriptions returned %v after a failed subscribe", subs)
+	}
+}
+
+func TestMedia(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("+OK\n"), apiResponse("+OK\n"))
+	if _, err := h.Media("abc", true); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api uuid_media abc" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if _, err := h.Media("abc", false); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api uuid_media off abc" {
+		t.Errorf("Sent %q", cmd)
+	}
+}
+
+func TestChat(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("Sent\n"))
+	if _, err := h.Chat("sip", "1000@example.com", "1001@example.com", "hello there"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api chat sip|1000@example.com|1001@example.com|hello there" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if _, err := h.Chat("sip", "1000@example.com", "1001@example.com", "a|b"); err != errInvalidArg {
+		t.Errorf("Chat with a | returned %v", err)
+	}
+}
+
+func TestDeflect(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("+OK\n"), apiResponse("-ERR Cannot deflect\n"))
+	if _, err := h.Deflect("abc", "sip:1001@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api uuid_deflect abc sip:1001@example.com" {
+		t.Errorf("Sent %q", cmd)
+	}
+	_, err := h.Deflect("abc", "sip:1001@example.com")
+	if cerr, ok := err.(*CommandError); !ok || cerr.Message != "Cannot deflect" {
+		t.Errorf("Deflect returned %#v", err)
+	}
+}
+
+func TestModules(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("+OK\n"), apiResponse("+OK\n"), apiResponse("+OK\n"),
+		apiResponse("-ERR [module load file routine returned an error]\n"))
+	for _, tc := range []struct {
+		fn   func(string) (*Event, error)
+		want string
+	}{
+		{h.LoadModule, "api load mod_sofia"},
+		{h.UnloadModule, "api unload mod_sofia"},
+		{h.ReloadModule, "api reload mod_sofia"},
+	} {
+		if _, err := tc.fn("mod_sofia"); err != nil {
+			t.Fatal(err)
+		}
+		if cmd := command(t, cmds); cmd != tc.want {
+			t.Errorf("Sent %q, want %q", cmd, tc.want)
+		}
+	}
+	if _, err := h.LoadModule("mod_nope"); err == nil {
+		t.Error("LoadModule of a missing module returned no error")
+	} else if _, ok := err.(*CommandError); !ok {
+		t.Errorf("LoadModule returned %#v, want a *CommandError", err)
+	}
+	if _, err := h.LoadModule("mod_sofia; shutdown"); err == nil {
+		t.Error("LoadModule of an invalid name returned no error")
+	}
+}
+
+func TestRecoveryRefresh(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("+OK recovered 2 session(s)\n"))
+	if _, err := h.RecoveryRefresh("internal"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api sofia profile internal recover" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if _, err := h.RecoveryRefresh("internal external"); err != errInvalidArg {
+		t.Errorf("RecoveryRefresh with a space returned %v", err)
+	}
+}
+
+func TestFlushDTMF(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("+OK\n"), apiResponse("-ERR No such channel!\n"))
+	if _, err := h.FlushDTMF("abc"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api uuid_flush_dtmf abc" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if _, err := h.FlushDTMF("abc"); err == nil {
+		t.Error("FlushDTMF of a missing channel returned no error")
+	}
+	if _, err := h.FlushDTMF(""); err != errInvalidArg {
+		t.Errorf("FlushDTMF without uuid returned %v", err)
+	}
+}
+
+func TestConcurrentRecordings(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("+OK Success\n"), apiResponse("+OK Success\n"))
+	a, err := h.RecordStart("abc", "/tmp/a.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := h.RecordStart("abc", "/tmp/b.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api uuid_record abc start /tmp/a.wav" {
+		t.Errorf("Sent %q", cmd)
+	}
+	command(t, cmds)
+	if _, err = h.RecordStart("abc", "/tmp/a.wav"); err == nil {
+		t.Error("Recording twice to the same path returned no error")
+	}
+	s.send(
+		plainEvent("Event-Name: RECORD_STOP\nRecord-File-Path: /tmp/b.wav\nvariable_record_ms: 2000\n\n"),
+		plainEvent("Event-Name: RECORD_STOP\nRecord-File-Path: /tmp/a.wav\nvariable_record_ms: 5000\n\n"),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, tc := range []struct {
+		rs   *RecordSession
+		want RecordingInfo
+	}{
+		{a, RecordingInfo{Path: "/tmp/a.wav", Duration: 5 * time.Second}},
+		{b, RecordingInfo{Path: "/tmp/b.wav", Duration: 2 * time.Second}},
+	} {
+		info, err := tc.rs.Wait(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *info != tc.want {
+			t.Errorf("Wait returned %+v, want %+v", *info, tc.want)
+		}
+	}
+}
+
+func TestRecordingClosed(t *testing.T) {
+	h, s := newTestConn(t)
+	s.reply(apiResponse("+OK Success\n"))
+	rs, err := h.RecordStart("abc", "/tmp/a.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err = rs.Wait(ctx); err != errClosed {
+		t.Errorf("Wait on a closed connection returned %v", err)
+	}
+	h.mu.Lock()
+	n := len(h.recordings)
+	h.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d recordings left after closing", n)
+	}
+}
+
+func TestLog(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(commandReply("+OK log level 7 [7]"))
+	if _, err := h.Log(LogLevelDebug); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "log 7" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if _, err := h.Log(LogLevel(8)); err == nil {
+		t.Error("Log with an invalid level returned no error")
+	}
+	line := "2013-01-02 15:04:05.123456 [DEBUG] switch_core_session.c:1234 hello\n"
+	s.send("Content-Type: log/data\nContent-Length: " + strconv.Itoa(len(line)) +
+		"\nLog-Level: 7\nText-Channel: 3\nLog-File: switch_core_session.c\n" +
+		"Log-Func: switch_core_session_run\nLog-Line: 1234\nUser-Data: abc\n\n" + line)
+	ev, err := h.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Get("Content-Type") != "log/data" || ev.Get("Log-Level") != "7" ||
+		ev.Get("Log-File") != "switch_core_session.c" {
+		t.Errorf("ReadEvent returned %v", ev)
+	}
+	if ev.Body != line {
+		t.Errorf("Log line is %q, want %q", ev.Body, line)
+	}
+
+	// Unknown content types are an error, not the end of the program.
+	s.send("Content-Type: text/unknown\n\n")
+	if _, err = h.ReadEvent(); err == nil {
+		t.Error("ReadEvent of an unknown content type returned no error")
+	}
+}
+
+func TestSubscribeEvents(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(commandReply("+OK event listener enabled json"),
+		commandReply("+OK event listener enabled json"),
+		commandReply("+OK event listener enabled json"))
+	if err := h.SubscribeEvents("json", "channel_answer"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "events json channel_answer" {
+		t.Errorf("Sent %q", cmd)
+	}
+	// Already subscribed, nothing is sent.
+	if err := h.SubscribeEvents("json", "CHANNEL_ANSWER"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SubscribeEvents("json", "CHANNEL_ANSWER", "CUSTOM", "sofia::register"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "events json CUSTOM sofia::register" {
+		t.Errorf("Sent %q", cmd)
+	}
+	// A new subclass still needs CUSTOM before it.
+	if err := h.SubscribeEvents("json", "CUSTOM", "sofia::register", "conference::maintenance"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "events json CUSTOM conference::maintenance" {
+		t.Errorf("Sent %q", cmd)
+	}
+	want := "CHANNEL_ANSWER,CUSTOM,conference::maintenance,sofia::register"
+	if subs := strings.Join(h.Subscriptions(), ","); subs != want {
+		t.Errorf("Subscriptions returned %s, want %s", subs, want)
+	}
+
+	// Events removed with nixevent and noevents can be subscribed to again.
+	cmds = s.reply(commandReply("+OK events removed"),
+		commandReply("+OK event listener enabled json"),
+		commandReply("+OK no longer listening for events"),
+		commandReply("+OK event listener enabled json"))
+	if _, err := h.Send("nixevent CUSTOM sofia::register"); err != nil {
+		t.Fatal(err)
+	}
+	command(t, cmds)
+	want = "CHANNEL_ANSWER,CUSTOM,conference::maintenance"
+	if subs := strings.Join(h.Subscriptions(), ","); subs != want {
+		t.Errorf("Subscriptions after nixevent returned %s, want %s", subs, want)
+	}
+	if err := h.SubscribeEvents("json", "CUSTOM", "sofia::register"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "events json CUSTOM sofia::register" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if _, err := h.Send("noevents"); err != nil {
+		t.Fatal(err)
+	}
+	command(t, cmds)
+	if subs := h.Subscriptions(); len(subs) != 0 {
+		t.Errorf("Subscriptions after noevents returned %v", subs)
+	}
+	if err := h.SubscribeEvents("json", "CHANNEL_ANSWER"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "events json CHANNEL_ANSWER" {
+		t.Errorf("Sent %q", cmd)
+	}
+}
+
+func TestSubscribeEventsConcurrent(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(commandReply("+OK event listener enabled plain"))
+	errc := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errc <- h.SubscribeEvents("plain", "CHANNEL_ANSWER")
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	command(t, cmds)
+	if n := h.PendingCommands(); n != 0 {
+		t.Errorf("%d more commands sent", n)
+	}
+}
+
+func TestUUIDExists(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("true"), apiResponse("false"), apiResponse("-ERR oops\n"))
+	for _, want := range []bool{true, false} {
+		ok, err := h.UUIDExists("abc")
+		if err != nil || ok != want {
+			t.Errorf("UUIDExists returned %v, %v, want %v", ok, err, want)
+		}
+		if cmd := command(t, cmds); cmd != "api uuid_exists abc" {
+			t.Errorf("Sent %q", cmd)
+		}
+	}
+	if _, err := h.UUIDExists("abc"); err == nil {
+		t.Error("UUIDExists returned no error for -ERR")
+	}
+}
+
+func TestConferenceRelate(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("+OK\n"), apiResponse("+OK\n"))
+	if _, err := h.ConferenceRelate("3000", "1", "2", "nohear"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api conference 3000 relate 1 2 nohear" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if _, err := h.ConferenceRelate("3000", "1", "2", "clear"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api conference 3000 relate 1 2 clear" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if _, err := h.ConferenceRelate("3000", "1", "2", ""); err != errInvalidArg {
+		t.Errorf("ConferenceRelate without flags returned %v", err)
+	}
+}
+
+func TestBgAPIWithJobUUID(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply("Content-Type: command/reply\nReply-Text: +OK Job-UUID: job1\nJob-UUID: job1\n\n")
+	job, err := h.BgAPIWithJobUUID("status", "job1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "bgapi status\nJob-UUID: job1" {
+		t.Errorf("Sent %q", cmd)
+	}
+	s.send(
+		plainEvent("Event-Name: BACKGROUND_JOB\nJob-UUID: other\n\n"),
+		plainEvent("Event-Name: BACKGROUND_JOB\nJob-UUID: job1\nContent-Length: 3\n\nUP\n"),
+	)
+	select {
+	case ev := <-job:
+		if ev.Body != "UP\n" {
+			t.Errorf("Job result is %q", ev.Body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No job result")
+	}
+	ev, err := h.ReadEvent()
+	if err != nil || ev.Get("Job-Uuid") != "other" {
+		t.Errorf("ReadEvent returned %v, %v", ev, err)
+	}
+
+	// Jobs still running when the connection closes are closed too.
+	s.reply("Content-Type: command/reply\nReply-Text: +OK Job-UUID: job2\nJob-UUID: job2\n\n")
+	if job, err = h.BgAPIWithJobUUID("status", "job2"); err != nil {
+		t.Fatal(err)
+	}
+	s.conn.Close()
+	select {
+	case ev, ok := <-job:
+		if ok {
+			t.Errorf("Job result is %v after closing", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Job channel not closed")
+	}
+}
+
+func TestSendDTMFTimed(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("+OK\n"), apiResponse("+OK\n"))
+	if _, err := h.SendDTMFTimed("abc", "12", 100*time.Millisecond, 0); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api uuid_send_dtmf abc 1@100+2@100" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if _, err := h.SendDTMFTimed("abc", "12", 100*time.Millisecond, 1500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api uuid_send_dtmf abc 1@100+Ww+2@100" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if _, err := h.SendDTMFTimed("abc", "1x", 100*time.Millisecond, 0); err == nil {
+		t.Error("SendDTMFTimed with an invalid digit returned no error")
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	h, s := newTestConn(t)
+	if _, err := h.ApplyDefaults("abc"); err != errNoDefaults {
+		t.Errorf("ApplyDefaults without defaults returned %v", err)
+	}
+	err := h.SetDefaults(map[string]string{
+		"hangup_after_bridge": "true",
+		"call_timeout":        "30",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds := s.reply(apiResponse("+OK\n"))
+	if _, err = h.ApplyDefaults("abc"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api uuid_setvar_multi abc call_timeout=30;hangup_after_bridge=true" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if n := h.PendingCommands(); n != 0 {
+		t.Errorf("%d more commands sent", n)
+	}
+	for _, value := range []string{"1;2", "John Doe", "a\nb"} {
+		if err = h.SetDefaults(map[string]string{"a": value}); err != errInvalidArg {
+			t.Errorf("SetDefaults of %q returned %v", value, err)
+		}
+	}
+}
+
+func TestPhoneEvent(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("+OK\n"))
+	if _, err := h.PhoneEvent("abc", "hold"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api uuid_phone_event abc hold" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if _, err := h.PhoneEvent("abc", "ring"); err == nil {
+		t.Error("PhoneEvent ring returned no error")
+	}
+}
+
+func TestGatewayStatus(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse(
+		"Profile::Gateway-Name\tData\tState\tPing Time\tIB Calls(F/T)\tOB Calls(F/T)\n" +
+			"=================================================================\n" +
+			"external::gw1\tsip:gw1@example.com\tREGED\t12.50\t0/0\t3/0\n" +
+			"internal::gw2\tsip:gw2@example.com\tNOREG\t0.00\t0/0\t0/0\n" +
+			"=================================================================\n" +
+			"2 gateways: Inbound(Failed/Total): 0/0, Outbound(Failed/Total): 3/0\n"))
+	gws, err := h.GatewayStatus("external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api sofia status gateway" {
+		t.Errorf("Sent %q", cmd)
+	}
+	want := GatewayInfo{Profile: "external", Name: "gw1", Data: "sip:gw1@example.com",
+		State: "REGED", PingTime: 12500 * time.Microsecond}
+	if len(gws) != 1 || gws[0] != want {
+		t.Errorf("GatewayStatus returned %+v, want %+v", gws, want)
+	}
+}
+
+func TestEventsForUUID(t *testing.T) {
+	h, s := newTestConn(t)
+	evc := h.EventsForUUID("abc")
+	if h.EventsForUUID("abc") != evc {
+		t.Error("EventsForUUID returned another channel for the same uuid")
+	}
+	s.send(
+		plainEvent("Event-Name: CHANNEL_ANSWER\nUnique-ID: other\n\n"),
+		plainEvent("Event-Name: CHANNEL_ANSWER\nUnique-ID: abc\n\n"),
+		plainEvent("Event-Name: HEARTBEAT\n\n"),
+	)
+	select {
+	case ev := <-evc:
+		if ev.UniqueID() != "abc" {
+			t.Errorf("Got the event of %q", ev.UniqueID())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No event for abc")
+	}
+	for _, want := range []string{"CHANNEL_ANSWER", "HEARTBEAT"} {
+		ev, err := h.ReadEvent()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Name() != want || ev.UniqueID() == "abc" {
+			t.Errorf("ReadEvent returned %v", ev)
+		}
+	}
+	if len(evc) != 0 {
+		t.Errorf("%d more events for abc", len(evc))
+	}
+}
+
+func TestEventsForUUIDSlowReader(t *testing.T) {
+	h, s := newTestConn(t)
+	evc := h.EventsForUUID("abc")
+	// Nobody reads evc, nor ReadEvent until the reply.
+	const overflow = 5
+	go func() {
+		if _, err := s.readCommand(); err != nil {
+			return
+		}
+		for i := 0; i < eventsQueue+overflow; i++ {
+			s.conn.Write([]byte(plainEvent("Event-Name: HEARTBEAT\nUnique-ID: abc\n\n")))
+		}
+		s.conn.Write([]byte(plainEvent("Event-Name: HEARTBEAT\n\n")))
+		s.conn.Write([]byte(apiResponse("+OK\n")))
+	}()
+	if _, err := h.Send("api status"); err != nil {
+		t.Fatal(err)
+	}
+	// The overflow is dropped, not handed to ReadEvent.
+	if ev, err := h.ReadEvent(); err != nil || ev.UniqueID() != "" {
+		t.Errorf("ReadEvent got %v, %v", ev, err)
+	}
+	if n := len(evc); n != eventsQueue {
+		t.Errorf("Reader got %d events, want %d", n, eventsQueue)
+	}
+	if n := h.DroppedEventsForUUID("abc"); n != overflow {
+		t.Errorf("DroppedEventsForUUID returned %d, want %d", n, overflow)
+	}
+	h.StopEventsForUUID("abc")
+	s.send(plainEvent("Event-Name: CHANNEL_HANGUP\nUnique-ID: abc\n\n"))
+	if ev, err := h.ReadEvent(); err != nil || ev.Name() != "CHANNEL_HANGUP" {
+		t.Errorf("ReadEvent after StopEventsForUUID returned %v, %v", ev, err)
+	}
+}
+
+func TestCanAcceptCall(t *testing.T) {
+	h, s := newTestConn(t)
+	status := func(n int) string {
+		return apiResponse("UP 0 years, 0 days\n" + strconv.Itoa(n) +
+			" session(s) - peak 10, last 5min 4\n")
+	}
+	limit := apiResponse("+OK max sessions: 10\n")
+	cmds := s.reply(limit, status(9), limit, status(9), limit, status(10))
+	if n, err := h.MaxSessions(); err != nil || n != 10 {
+		t.Errorf("MaxSessions returned %d, %v", n, err)
+	}
+	if cmd := command(t, cmds); cmd != "api fsctl max_sessions" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if n, err := h.Sessions(); err != nil || n != 9 {
+		t.Errorf("Sessions returned %d, %v", n, err)
+	}
+	if ok, err := h.CanAcceptCall(); err != nil || !ok {
+		t.Errorf("CanAcceptCall below the limit returned %v, %v", ok, err)
+	}
+	if ok, err := h.CanAcceptCall(); err != nil || ok {
+		t.Errorf("CanAcceptCall at the limit returned %v, %v", ok, err)
+	}
+}
+
+func TestShowCalls(t *testing.T) {
+	h, s := newTestConn(t)
+	rows := `{"row_count":2,"rows":[` +
+		`{"uuid":"a1","cid_name":"Alice","cid_num":"1000","dest":"2000","callee_num":"2000",` +
+		`"callstate":"ACTIVE","created_epoch":"1357139045","b_uuid":"b1","b_cid_name":"Bob","b_cid_num":"2000"},` +
+		`{"uuid":"a2","cid_num":"1001","dest":"9196","callstate":"RINGING","created_epoch":""}]}`
+	cmds := s.reply(apiResponse(rows))
+	calls, err := h.ShowCalls()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api show calls as json" {
+		t.Errorf("Sent %q", cmd)
+	}
+	want := []CallPair{
+		{UUID: "a1", CallerIDName: "Alice", CallerIDNumber: "1000", Destination: "2000",
+			CalleeNumber: "2000", CallState: "ACTIVE", Created: time.Unix(1357139045, 0),
+			BUUID: "b1", BCallerIDName: "Bob", BCallerIDNumber: "2000"},
+		{UUID: "a2", CallerIDNumber: "1001", Destination: "9196", CallState: "RINGING"},
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("ShowCalls returned %+v, want %+v", calls, want)
+	}
+}
+
+func TestDualTransfer(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("+OK\n"))
+	if _, err := h.DualTransfer("abc", "1000/XML/default", "2000"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api uuid_dual_transfer abc 1000/XML/default 2000" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if _, err := h.DualTransfer("abc", "1000 XML", "2000"); err != errInvalidArg {
+		t.Errorf("DualTransfer with a space returned %v", err)
+	}
+}
+
+func TestJitterBuffer(t *testing.T) {
+	h, s := newTestConn(t)
+	valid := []string{"60", "60:200:40", "0", "off", "pause", "resume"}
+	frames := make([]string, len(valid))
+	for n := range frames {
+		frames[n] = apiResponse("+OK\n")
+	}
+	cmds := s.reply(frames...)
+	for _, spec := range valid {
+		if _, err := h.JitterBuffer("abc", spec); err != nil {
+			t.Fatalf("JitterBuffer(%q) returned %v", spec, err)
+		}
+		if cmd := command(t, cmds); cmd != "api uuid_jitterbuffer abc "+spec {
+			t.Errorf("Sent %q", cmd)
+		}
+	}
+	for _, spec := range []string{"", "on", "60:200:40:10", "-60", "60::40", "60 200"} {
+		if _, err := h.JitterBuffer("abc", spec); err == nil {
+			t.Errorf("JitterBuffer(%q) returned no error", spec)
+		}
+	}
+}
@@ -0,0 +1,556 @@
+// Copyright 2013 Alexandre Fiori
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package eventsocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Name returns the Event-Name header of the event, e.g. CHANNEL_ANSWER.
+func (r *Event) Name() string {
+	return r.Get("Event-Name")
+}
+
+// CoreUUID returns the UUID of the FreeSWITCH instance that fired the event,
+// from the Core-UUID header. It is not related to any call.
+func (r *Event) CoreUUID() string {
+	return r.Get("Core-Uuid")
+}
+
+// UniqueID returns the UUID of the channel the event is about, from the
+// Unique-ID header.
+func (r *Event) UniqueID() string {
+	return r.Get("Unique-Id")
+}
+
+// CallerUniqueID returns the UUID of the channel from the caller profile,
+// from the Caller-Unique-ID header. It usually matches UniqueID.
+func (r *Event) CallerUniqueID() string {
+	return r.Get("Caller-Unique-Id")
+}
+
+// expect returns an error unless the event is named name.
+func (r *Event) expect(name string) error {
+	if n := r.Name(); n != name {
+		return fmt.Errorf("Unexpected event %q, want %s", n, name)
+	}
+	return nil
+}
+
+// IsPlaybackStop returns true if this is a PLAYBACK_STOP event.
+func (r *Event) IsPlaybackStop() bool {
+	return r.Name() == "PLAYBACK_STOP"
+}
+
+// PlaybackTerminator returns the DTMF digit that interrupted the playback,
+// or "" if the playback was not interrupted or this is not a PLAYBACK_STOP
+// event.
+func (r *Event) PlaybackTerminator() string {
+	if !r.IsPlaybackStop() {
+		return ""
+	}
+	return r.Variable("playback_terminator_used")
+}
+
+// RecordingInfo describes a finished recording.
+type RecordingInfo struct {
+	Path     string        // Record-File-Path
+	Duration time.Duration // From record_ms, or record_seconds
+}
+
+// Recording returns the file path and duration of the recording reported by
+// a RECORD_STOP event.
+func (r *Event) Recording() (*RecordingInfo, error) {
+	if err := r.expect("RECORD_STOP"); err != nil {
+		return nil, err
+	}
+	info := &RecordingInfo{Path: r.Get("Record-File-Path")}
+	if v := r.Variable("record_ms"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		info.Duration = time.Duration(n) * time.Millisecond
+	} else if v := r.Variable("record_seconds"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		info.Duration = time.Duration(n) * time.Second
+	}
+	return info, nil
+}
+
+// ChannelState is the state of a channel, as in the Channel-State header.
+type ChannelState string
+
+// Channel states.
+const (
+	ChannelStateNew           ChannelState = "CS_NEW"
+	ChannelStateInit          ChannelState = "CS_INIT"
+	ChannelStateRouting       ChannelState = "CS_ROUTING"
+	ChannelStateSoftExecute   ChannelState = "CS_SOFT_EXECUTE"
+	ChannelStateExecute       ChannelState = "CS_EXECUTE"
+	ChannelStateExchangeMedia ChannelState = "CS_EXCHANGE_MEDIA"
+	ChannelStatePark          ChannelState = "CS_PARK"
+	ChannelStateConsumeMedia  ChannelState = "CS_CONSUME_MEDIA"
+	ChannelStateHibernate     ChannelState = "CS_HIBERNATE"
+	ChannelStateReset         ChannelState = "CS_RESET"
+	ChannelStateHangup        ChannelState = "CS_HANGUP"
+	ChannelStateReporting     ChannelState = "CS_REPORTING"
+	ChannelStateDestroy       ChannelState = "CS_DESTROY"
+)
+
+// WaitForState reads events until the channel uuid reaches state, and
+// returns the CHANNEL_STATE event that reported it. It returns an error if
+// the channel hangs up first, or when ctx is done.
+//
+// It requires a subscription to CHANNEL_STATE and CHANNEL_HANGUP events, and
+// all events read while waiting are discarded.
+func (h *Connection) WaitForState(ctx context.Context, uuid string, state ChannelState) (*Event, error) {
+	for {
+		ev, err := h.readEventContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if ev.UniqueID() != uuid {
+			continue
+		}
+		switch ev.Name() {
+		case "CHANNEL_STATE":
+			cs := ChannelState(ev.Get("Channel-State"))
+			if cs == state {
+				return ev, nil
+			}
+			if cs == ChannelStateHangup || cs == ChannelStateReporting || cs == ChannelStateDestroy {
+				return nil, errHangup
+			}
+		case "CHANNEL_HANGUP", "CHANNEL_HANGUP_COMPLETE", "CHANNEL_DESTROY":
+			return nil, errHangup
+		}
+	}
+}
+
+// PresenceInfo holds the fields of PRESENCE_IN and PRESENCE_OUT events.
+type PresenceInfo struct {
+	Proto       string // e.g. sip
+	From        string // e.g. 1000@example.com
+	Status      string // e.g. Available
+	RPID        string // e.g. unknown
+	EventType   string // e.g. presence
+	AnswerState string // e.g. confirmed
+}
+
+// Presence returns the presence information of a PRESENCE_IN or PRESENCE_OUT
+// event.
+func (r *Event) Presence() (*PresenceInfo, error) {
+	if n := r.Name(); n != "PRESENCE_IN" && n != "PRESENCE_OUT" {
+		return nil, r.expect("PRESENCE_IN")
+	}
+	return &PresenceInfo{
+		Proto:       r.Get("Proto"),
+		From:        r.Get("From"),
+		Status:      r.Get("Status"),
+		RPID:        r.Get("Rpid"),
+		EventType:   r.Get("Event_Type"),
+		AnswerState: r.Get("Answer-State"),
+	}, nil
+}
+
+// ExecuteResult is the outcome of an application run by Execute.
+type ExecuteResult struct {
+	Application string // e.g. playback
+	Data        string // Arguments of the application
+	Response    string // e.g. FILE PLAYED
+	UUID        string // The event-uuid given to Execute, if any
+}
+
+// ExecuteResult returns the outcome of the application reported by a
+// CHANNEL_EXECUTE_COMPLETE event.
+func (r *Event) ExecuteResult() (*ExecuteResult, error) {
+	if err := r.expect("CHANNEL_EXECUTE_COMPLETE"); err != nil {
+		return nil, err
+	}
+	return &ExecuteResult{
+		Application: r.Get("Application"),
+		Data:        r.Get("Application-Data"),
+		Response:    r.Get("Application-Response"),
+		UUID:        r.Get("Application-Uuid"),
+	}, nil
+}
+
+// DTMF returns the digit and duration reported by a DTMF event, or "" and
+// zero for other events.
+//
+// FreeSWITCH reports DTMF-Duration in samples at 8kHz, regardless of the
+// codec in use.
+func (r *Event) DTMF() (digit string, duration time.Duration) {
+	if r.Name() != "DTMF" {
+		return "", 0
+	}
+	if n, err := strconv.Atoi(r.Get("Dtmf-Duration")); err == nil {
+		duration = time.Duration(n) * time.Second / 8000
+	}
+	return r.Get("Dtmf-Digit"), duration
+}
+
+// getTime returns the value of a timestamp header in microseconds since the
+// epoch, such as Caller-Channel-Created-Time. It returns the zero time if
+// the header is missing or 0, meaning the call didn't get there.
+func (r *Event) getTime(key string) (time.Time, error) {
+	v := r.Get(key)
+	if v == "" || v == "0" {
+		return time.Time{}, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, n*int64(time.Microsecond)), nil
+}
+
+// IsProgressMedia reports whether the event is a CHANNEL_PROGRESS_MEDIA
+// event, fired when early media starts on the channel.
+func (r *Event) IsProgressMedia() bool {
+	return r.Name() == "CHANNEL_PROGRESS_MEDIA"
+}
+
+// ProgressTime returns the time the channel started ringing, from the
+// Caller-Channel-Progress-Time header. It's zero if it didn't.
+func (r *Event) ProgressTime() (time.Time, error) {
+	return r.getTime("Caller-Channel-Progress-Time")
+}
+
+// ProgressMediaTime returns the time early media started on the channel,
+// from the Caller-Channel-Progress-Media-Time header. It's zero if it
+// didn't.
+func (r *Event) ProgressMediaTime() (time.Time, error) {
+	return r.getTime("Caller-Channel-Progress-Media-Time")
+}
+
+// CallTimings holds the timestamps of a call and the latencies computed from
+// them. Timestamps are zero when the call didn't get there, e.g. Answered for
+// unanswered calls, and so are the durations depending on them.
+type CallTimings struct {
+	Created  time.Time
+	Progress time.Time // Ringing or early media, whichever came first
+	Answered time.Time
+	Hangup   time.Time
+
+	PostDialDelay time.Duration // From Created to Progress
+	SetupTime     time.Duration // From Progress to Answered
+}
+
+// CallTimings returns the timestamps of the call from the Caller-Channel-*
+// headers, e.g. of a CHANNEL_HANGUP_COMPLETE event.
+func (r *Event) CallTimings() (*CallTimings, error) {
+	var (
+		ct    CallTimings
+		media time.Time
+		err   error
+	)
+	for _, f := range []struct {
+		key string
+		t   *time.Time
+	}{
+		{"Caller-Channel-Created-Time", &ct.Created},
+		{"Caller-Channel-Progress-Time", &ct.Progress},
+		{"Caller-Channel-Progress-Media-Time", &media},
+		{"Caller-Channel-Answered-Time", &ct.Answered},
+		{"Caller-Channel-Hangup-Time", &ct.Hangup},
+	} {
+		if *f.t, err = r.getTime(f.key); err != nil {
+			return nil, err
+		}
+	}
+	if ct.Progress.IsZero() || (!media.IsZero() && media.Before(ct.Progress)) {
+		ct.Progress = media
+	}
+	if !ct.Created.IsZero() && !ct.Progress.IsZero() {
+		ct.PostDialDelay = ct.Progress.Sub(ct.Created)
+	}
+	if !ct.Progress.IsZero() && !ct.Answered.IsZero() {
+		ct.SetupTime = ct.Answered.Sub(ct.Progress)
+	}
+	return &ct, nil
+}
+
+// SourceIP returns the IPv4 address of the FreeSWITCH instance that fired
+// the event, from the FreeSWITCH-IPv4 header, or nil if it's missing or
+// invalid.
+func (r *Event) SourceIP() net.IP {
+	return net.ParseIP(r.Get("Freeswitch-Ipv4"))
+}
+
+// CallerIP returns the network address of the caller, from the
+// Caller-Network-Addr header, or nil if it's missing or invalid. Values with
+// a scheme or port, such as sip:1.2.3.4:5060, are accepted.
+func (r *Event) CallerIP() net.IP {
+	addr := strings.TrimSpace(r.Get("Caller-Network-Addr"))
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip
+	}
+	if n := strings.Index(addr, ":"); n > 0 && !strings.ContainsAny(addr[:n], "0123456789.[") {
+		addr = addr[n+1:]
+	}
+	if n := strings.LastIndex(addr, "@"); n >= 0 {
+		addr = addr[n+1:]
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
+
+// CDR is the call detail record of a channel, from its
+// CHANNEL_HANGUP_COMPLETE event.
+type CDR struct {
+	UUID           string
+	CallerIDName   string
+	CallerIDNumber string
+	Destination    string
+	HangupCause    string
+	Duration       time.Duration // From creation to hangup
+	Billsec        time.Duration // From answer to hangup
+	Timings        *CallTimings
+}
+
+// CDR returns the call detail record of a CHANNEL_HANGUP_COMPLETE event.
+func (r *Event) CDR() (*CDR, error) {
+	if err := r.expect("CHANNEL_HANGUP_COMPLETE"); err != nil {
+		return nil, err
+	}
+	timings, err := r.CallTimings()
+	if err != nil {
+		return nil, err
+	}
+	cdr := &CDR{
+		UUID:           r.UniqueID(),
+		CallerIDName:   r.Get("Caller-Caller-Id-Name"),
+		CallerIDNumber: r.Get("Caller-Caller-Id-Number"),
+		Destination:    r.Get("Caller-Destination-Number"),
+		HangupCause:    r.Get("Hangup-Cause"),
+		Timings:        timings,
+	}
+	for _, f := range []struct {
+		name string
+		d    *time.Duration
+	}{
+		{"duration", &cdr.Duration},
+		{"billsec", &cdr.Billsec},
+	} {
+		v := r.Variable(f.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		*f.d = time.Duration(n) * time.Second
+	}
+	return cdr, nil
+}
+
+// WaitForHangupComplete reads events until CHANNEL_HANGUP_COMPLETE and
+// returns its call detail record, or an error when ctx is done. Other events
+// read while waiting are discarded.
+//
+// On outbound connections it requires linger, otherwise the connection is
+// closed before the event is sent:
+//
+//	c.Send("linger")
+//	c.Send("myevents")
+//	...
+//	cdr, err := c.WaitForHangupComplete(ctx)
+func (h *Connection) WaitForHangupComplete(ctx context.Context) (*CDR, error) {
+	for {
+		ev, err := h.readEventContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if ev.Name() == "CHANNEL_HANGUP_COMPLETE" {
+			return ev.CDR()
+		}
+	}
+}
+
+// FaxResult is the outcome of a fax sent or received with mod_spandsp.
+type FaxResult struct {
+	Success          bool
+	ResultCode       int
+	ResultText       string // e.g. OK
+	PagesTransferred int
+	TotalPages       int
+	ECM              bool // Error correction mode was used
+	RemoteStationID  string
+}
+
+// FaxResult returns the outcome of a fax from a spandsp::rxfaxresult or
+// spandsp::txfaxresult event.
+func (r *Event) FaxResult() (*FaxResult, error) {
+	switch r.Get("Event-Subclass") {
+	case "spandsp::rxfaxresult", "spandsp::txfaxresult":
+	default:
+		return nil, fmt.Errorf("Unexpected event %q, want spandsp::rxfaxresult or spandsp::txfaxresult",
+			r.Get("Event-Subclass"))
+	}
+	res := &FaxResult{
+		ResultText:      r.Get("Fax-Result-Text"),
+		RemoteStationID: r.Get("Fax-Remote-Station-Id"),
+	}
+	for _, f := range []struct {
+		key string
+		n   *int
+	}{
+		{"Fax-Result-Code", &res.ResultCode},
+		{"Fax-Document-Transferred-Pages", &res.PagesTransferred},
+		{"Fax-Document-Total-Pages", &res.TotalPages},
+	} {
+		if r.Get(f.key) == "" {
+			continue
+		}
+		n, err := r.GetInt(f.key)
+		if err != nil {
+			return nil, err
+		}
+		*f.n = n
+	}
+	for _, f := range []struct {
+		key string
+		b   *bool
+	}{
+		{"Fax-Success", &res.Success},
+		{"Fax-Ecm-Used", &res.ECM},
+	} {
+		if r.Get(f.key) == "" {
+			continue
+		}
+		b, err := r.GetBool(f.key)
+		if err != nil {
+			return nil, err
+		}
+		*f.b = b
+	}
+	return res, nil
+}
+
+// DetectedTone returns the name of the tone reported by a DETECTED_TONE
+// event, as given to tone_detect or spandsp_start_tone_detect, and true. It
+// returns "" and false for other events.
+func (r *Event) DetectedTone() (name string, ok bool) {
+	if r.Name() != "DETECTED_TONE" {
+		return "", false
+	}
+	return r.Get("Detected-Tone"), true
+}
+
+// MWIInfo is the message waiting indication of a voicemail account.
+type MWIInfo struct {
+	Account     string // e.g. sip:1000@example.com
+	Waiting     bool   // Whether there are new messages
+	New         int
+	Saved       int
+	UrgentNew   int
+	UrgentSaved int
+}
+
+// MWI returns the message waiting indication reported by a MESSAGE_WAITING
+// event.
+func (r *Event) MWI() (*MWIInfo, error) {
+	if err := r.expect("MESSAGE_WAITING"); err != nil {
+		return nil, err
+	}
+	waiting, err := r.GetBool("Mwi-Messages-Waiting")
+	if err != nil {
+		return nil, err
+	}
+	mwi := &MWIInfo{
+		Account: r.Get("Mwi-Message-Account"),
+		Waiting: waiting,
+	}
+	// Formatted as new/saved (urgent new/urgent saved), the urgent counts
+	// being optional.
+	if v := r.Get("Mwi-Voice-Message"); v != "" {
+		if strings.Contains(v, "(") {
+			_, err = fmt.Sscanf(v, "%d/%d (%d/%d)",
+				&mwi.New, &mwi.Saved, &mwi.UrgentNew, &mwi.UrgentSaved)
+		} else {
+			_, err = fmt.Sscanf(v, "%d/%d", &mwi.New, &mwi.Saved)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Mwi-Voice-Message %q", v)
+		}
+	}
+	return mwi, nil
+}
+
+// AudioQuality is the quality of the audio received on a channel, from the
+// RTP statistics of its CHANNEL_HANGUP_COMPLETE event.
+type AudioQuality struct {
+	MOS         float64 // Mean opinion score, from 1 to 5
+	Quality     float64 // Quality percentage
+	Packets     int     // Media packets received
+	LostPackets int
+	PacketLoss  float64 // Percentage of the packets lost
+	JitterMin   float64 // Minimum jitter variance, in ms
+	JitterMax   float64 // Maximum jitter variance, in ms
+}
+
+// AudioQuality returns the quality of the audio received on the channel,
+// from the rtp_audio_in_* variables of a CHANNEL_HANGUP_COMPLETE event. It
+// returns an error if there are no RTP statistics, e.g. for calls without
+// media.
+func (r *Event) AudioQuality() (*AudioQuality, error) {
+	if err := r.expect("CHANNEL_HANGUP_COMPLETE"); err != nil {
+		return nil, err
+	}
+	if r.Variable("rtp_audio_in_mos") == "" {
+		return nil, errors.New("Event has no RTP statistics")
+	}
+	var q AudioQuality
+	for _, f := range []struct {
+		name string
+		v    *float64
+	}{
+		{"rtp_audio_in_mos", &q.MOS},
+		{"rtp_audio_in_quality_percentage", &q.Quality},
+		{"rtp_audio_in_jitter_min_variance", &q.JitterMin},
+		{"rtp_audio_in_jitter_max_variance", &q.JitterMax},
+	} {
+		if v := r.Variable(f.name); v != "" {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s %q", f.name, v)
+			}
+			*f.v = n
+		}
+	}
+	for _, f := range []struct {
+		name string
+		v    *int
+	}{
+		{"rtp_audio_in_media_packet_count", &q.Packets},
+		{"rtp_audio_in_skip_packet_count", &q.LostPackets},
+	} {
+		if v := r.Variable(f.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s %q", f.name, v)
+			}
+			*f.v = n
+		}
+	}
+	if total := q.Packets + q.LostPackets; total > 0 {
+		q.PacketLoss = 100 * float64(q.LostPackets) / float64(total)
+	}
+	return &q, nil
+}
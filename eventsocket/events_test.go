@@ -0,0 +1,375 @@
+// Copyright 2013 Alexandre Fiori
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package eventsocket
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPlaybackStop(t *testing.T) {
+	ev := readTestEvent(t, "Event-Name: PLAYBACK_STOP\n"+
+		"variable_playback_terminator_used: #\n\n")
+	if !ev.IsPlaybackStop() {
+		t.Error("IsPlaybackStop returned false")
+	}
+	if d := ev.PlaybackTerminator(); d != "#" {
+		t.Errorf("PlaybackTerminator returned %q, want #", d)
+	}
+	ev = readTestEvent(t, "Event-Name: PLAYBACK_START\n\n")
+	if ev.IsPlaybackStop() || ev.PlaybackTerminator() != "" {
+		t.Error("PLAYBACK_START taken for PLAYBACK_STOP")
+	}
+}
+
+func TestRecording(t *testing.T) {
+	for _, tc := range []struct {
+		vars string
+		want time.Duration
+	}{
+		{"variable_record_ms: 5250\n", 5250 * time.Millisecond},
+		{"variable_record_seconds: 5\n", 5 * time.Second},
+		{"", 0},
+	} {
+		ev := readTestEvent(t, "Event-Name: RECORD_STOP\n"+
+			"Record-File-Path: /tmp/rec%20a.wav\n"+tc.vars+"\n")
+		info, err := ev.Recording()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Path != "/tmp/rec a.wav" || info.Duration != tc.want {
+			t.Errorf("Recording returned %+v, want %v long /tmp/rec a.wav", info, tc.want)
+		}
+	}
+	ev := readTestEvent(t, "Event-Name: RECORD_START\n\n")
+	if _, err := ev.Recording(); err == nil {
+		t.Error("Recording accepted a RECORD_START event")
+	}
+}
+
+func TestWaitForState(t *testing.T) {
+	h, s := newTestConn(t)
+	s.send(
+		plainEvent("Event-Name: CHANNEL_STATE\nUnique-ID: other\nChannel-State: CS_EXECUTE\n\n"),
+		plainEvent("Event-Name: CHANNEL_STATE\nUnique-ID: abc\nChannel-State: CS_ROUTING\n\n"),
+		plainEvent("Event-Name: CHANNEL_STATE\nUnique-ID: abc\nChannel-State: CS_EXECUTE\n\n"),
+		plainEvent("Event-Name: CHANNEL_HANGUP\nUnique-ID: abc\n\n"),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ev, err := h.WaitForState(ctx, "abc", ChannelStateExecute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.UniqueID() != "abc" || ev.Get("Channel-State") != "CS_EXECUTE" {
+		t.Errorf("WaitForState returned %v", ev)
+	}
+	if _, err = h.WaitForState(ctx, "abc", ChannelStatePark); err != errHangup {
+		t.Errorf("WaitForState after hangup returned %v, want %v", err, errHangup)
+	}
+}
+
+func TestGetBool(t *testing.T) {
+	ev := &Event{Header: EventHeader{}}
+	for v, want := range map[string]bool{
+		"true": true, "YES": true, "on": true, "1": true,
+		"false": false, "No": false, "off": false, "0": false,
+	} {
+		ev.Header["Answered"] = v
+		got, err := ev.GetBool("Answered")
+		if err != nil || got != want {
+			t.Errorf("GetBool of %q returned %v, %v", v, got, err)
+		}
+	}
+	ev.Header["Answered"] = "maybe"
+	if _, err := ev.GetBool("Answered"); err == nil {
+		t.Error("GetBool of maybe returned no error")
+	}
+	if _, err := ev.GetBool("Missing"); err == nil {
+		t.Error("GetBool of a missing header returned no error")
+	}
+}
+
+func TestPresence(t *testing.T) {
+	ev := readTestEvent(t, "Event-Name: PRESENCE_IN\nproto: sip\n"+
+		"from: 1000%40example.com\nstatus: Available\nrpid: unknown\n"+
+		"event_type: presence\nanswer-state: confirmed\n\n")
+	p, err := ev.Presence()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PresenceInfo{Proto: "sip", From: "1000@example.com", Status: "Available",
+		RPID: "unknown", EventType: "presence", AnswerState: "confirmed"}
+	if *p != want {
+		t.Errorf("Presence returned %+v, want %+v", *p, want)
+	}
+	ev = readTestEvent(t, "Event-Name: CHANNEL_ANSWER\n\n")
+	if _, err = ev.Presence(); err == nil {
+		t.Error("Presence of CHANNEL_ANSWER returned no error")
+	}
+}
+
+func TestEventUUIDs(t *testing.T) {
+	ev := readTestEvent(t, "Event-Name: CHANNEL_ANSWER\nCore-UUID: core\n"+
+		"Unique-ID: leg\nCaller-Unique-ID: caller\n\n")
+	if ev.CoreUUID() != "core" || ev.UniqueID() != "leg" || ev.CallerUniqueID() != "caller" {
+		t.Errorf("Got CoreUUID %q, UniqueID %q, CallerUniqueID %q",
+			ev.CoreUUID(), ev.UniqueID(), ev.CallerUniqueID())
+	}
+}
+
+func TestExecuteResult(t *testing.T) {
+	ev := readTestEvent(t, "Event-Name: CHANNEL_EXECUTE_COMPLETE\n"+
+		"Application: playback\nApplication-Data: /tmp/test.wav\n"+
+		"Application-Response: FILE%20PLAYED\nApplication-UUID: app1\n\n")
+	res, err := ev.ExecuteResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ExecuteResult{Application: "playback", Data: "/tmp/test.wav",
+		Response: "FILE PLAYED", UUID: "app1"}
+	if *res != want {
+		t.Errorf("ExecuteResult returned %+v, want %+v", *res, want)
+	}
+	ev = readTestEvent(t, "Event-Name: CHANNEL_EXECUTE\n\n")
+	if _, err = ev.ExecuteResult(); err == nil {
+		t.Error("ExecuteResult of CHANNEL_EXECUTE returned no error")
+	}
+}
+
+func TestDTMF(t *testing.T) {
+	ev := readTestEvent(t, "Event-Name: DTMF\nDTMF-Digit: 5\nDTMF-Duration: 1600\n\n")
+	digit, d := ev.DTMF()
+	if digit != "5" || d != 200*time.Millisecond {
+		t.Errorf("DTMF returned %q, %v", digit, d)
+	}
+	ev = readTestEvent(t, "Event-Name: CHANNEL_ANSWER\n\n")
+	if digit, d = ev.DTMF(); digit != "" || d != 0 {
+		t.Errorf("DTMF of CHANNEL_ANSWER returned %q, %v", digit, d)
+	}
+}
+
+func TestSplitVariables(t *testing.T) {
+	h, s := newTestConn(t)
+	h.SetSplitVariables(true)
+	s.send(
+		plainEvent("Event-Name: PLAYBACK_STOP\nvariable_playback_terminator_used: #\n"+
+			"variable_sip_call_id: x%40y\n\n"),
+		plainEvent("Event-Name: RECORD_STOP\nRecord-File-Path: /tmp/a.wav\n"+
+			"variable_record_ms: 2500\n\n"),
+	)
+	ev, err := h.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := ev.Variables["sip_call_id"]; v != "x@y" {
+		t.Errorf("Variables has sip_call_id %q", v)
+	}
+	if _, ok := ev.Header["Variable_sip_call_id"]; ok {
+		t.Error("Variable left in the headers")
+	}
+	if v := ev.Variable("sip_call_id"); v != "x@y" {
+		t.Errorf("Variable returned %q", v)
+	}
+	if d := ev.PlaybackTerminator(); d != "#" {
+		t.Errorf("PlaybackTerminator returned %q", d)
+	}
+	if ev, err = h.ReadEvent(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := ev.Recording()
+	if err != nil || info.Duration != 2500*time.Millisecond {
+		t.Errorf("Recording returned %+v, %v", info, err)
+	}
+}
+
+func TestCallTimings(t *testing.T) {
+	ev := readTestEvent(t, "Event-Name: CHANNEL_HANGUP_COMPLETE\n"+
+		"Caller-Channel-Created-Time: 1357139040000000\n"+
+		"Caller-Channel-Progress-Time: 1357139042000000\n"+
+		"Caller-Channel-Progress-Media-Time: 1357139041500000\n"+
+		"Caller-Channel-Answered-Time: 1357139045000000\n"+
+		"Caller-Channel-Hangup-Time: 1357139105000000\n\n")
+	ct, err := ev.CallTimings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct.PostDialDelay != 1500*time.Millisecond {
+		t.Errorf("PostDialDelay is %v, want the early media time", ct.PostDialDelay)
+	}
+	if ct.SetupTime != 3500*time.Millisecond {
+		t.Errorf("SetupTime is %v", ct.SetupTime)
+	}
+	if d := ct.Hangup.Sub(ct.Answered); d != time.Minute {
+		t.Errorf("Answered for %v", d)
+	}
+
+	ev = readTestEvent(t, "Event-Name: CHANNEL_HANGUP_COMPLETE\n"+
+		"Caller-Channel-Created-Time: 1357139040000000\n"+
+		"Caller-Channel-Answered-Time: 0\n\n")
+	if ct, err = ev.CallTimings(); err != nil {
+		t.Fatal(err)
+	}
+	if !ct.Answered.IsZero() || ct.PostDialDelay != 0 || ct.SetupTime != 0 {
+		t.Errorf("Unanswered call has timings %+v", ct)
+	}
+}
+
+func TestSourceIP(t *testing.T) {
+	ev := readTestEvent(t, "Event-Name: HEARTBEAT\nFreeSWITCH-IPv4: 10.0.0.5\n\n")
+	if ip := ev.SourceIP(); !ip.Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("SourceIP returned %v", ip)
+	}
+	ev = readTestEvent(t, "Event-Name: HEARTBEAT\n\n")
+	if ip := ev.SourceIP(); ip != nil {
+		t.Errorf("SourceIP without the header returned %v", ip)
+	}
+}
+
+func TestWaitForHangupComplete(t *testing.T) {
+	h, s := newTestConn(t)
+	s.send(
+		plainEvent("Event-Name: CHANNEL_HANGUP\nUnique-ID: abc\n\n"),
+		plainEvent("Event-Name: CHANNEL_HANGUP_COMPLETE\nUnique-ID: abc\n"+
+			"Hangup-Cause: NORMAL_CLEARING\nCaller-Caller-ID-Number: 1000\n"+
+			"Caller-Destination-Number: 1001\nvariable_duration: 65\n"+
+			"variable_billsec: 60\n\n"),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	cdr, err := h.WaitForHangupComplete(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cdr.UUID != "abc" || cdr.HangupCause != "NORMAL_CLEARING" ||
+		cdr.CallerIDNumber != "1000" || cdr.Destination != "1001" {
+		t.Errorf("CDR is %+v", cdr)
+	}
+	if cdr.Billsec != time.Minute || cdr.Duration != 65*time.Second {
+		t.Errorf("CDR has billsec %v and duration %v", cdr.Billsec, cdr.Duration)
+	}
+}
+
+func TestFaxResult(t *testing.T) {
+	ev := readTestEvent(t, "Event-Name: CUSTOM\nEvent-Subclass: spandsp::rxfaxresult\n"+
+		"fax-success: 1\nfax-result-code: 0\nfax-result-text: OK\n"+
+		"fax-document-transferred-pages: 3\nfax-document-total-pages: 3\n"+
+		"fax-ecm-used: on\nfax-remote-station-id: 5551234\n\n")
+	res, err := ev.FaxResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FaxResult{Success: true, ResultText: "OK", PagesTransferred: 3,
+		TotalPages: 3, ECM: true, RemoteStationID: "5551234"}
+	if *res != want {
+		t.Errorf("FaxResult returned %+v, want %+v", *res, want)
+	}
+	ev = readTestEvent(t, "Event-Name: CUSTOM\nEvent-Subclass: sofia::register\n\n")
+	if _, err = ev.FaxResult(); err == nil {
+		t.Error("FaxResult of sofia::register returned no error")
+	}
+}
+
+func TestDetectedTone(t *testing.T) {
+	ev := readTestEvent(t, "Event-Name: DETECTED_TONE\nDetected-Tone: fax\n\n")
+	if name, ok := ev.DetectedTone(); !ok || name != "fax" {
+		t.Errorf("DetectedTone returned %q, %v", name, ok)
+	}
+	ev = readTestEvent(t, "Event-Name: DTMF\n\n")
+	if name, ok := ev.DetectedTone(); ok || name != "" {
+		t.Errorf("DetectedTone of DTMF returned %q, %v", name, ok)
+	}
+}
+
+func TestCallerIP(t *testing.T) {
+	for addr, want := range map[string]string{
+		"1.2.3.4":               "1.2.3.4",
+		"sip:1.2.3.4:5060":      "1.2.3.4",
+		"sip:1000@1.2.3.4:5060": "1.2.3.4",
+		"[2001:db8::1]:5060":    "2001:db8::1",
+		"not an address":        "",
+	} {
+		ev := &Event{Header: EventHeader{"Caller-Network-Addr": addr}}
+		ip := ev.CallerIP()
+		if want == "" {
+			if ip != nil {
+				t.Errorf("CallerIP of %q returned %v", addr, ip)
+			}
+			continue
+		}
+		if !ip.Equal(net.ParseIP(want)) {
+			t.Errorf("CallerIP of %q returned %v, want %s", addr, ip, want)
+		}
+	}
+}
+
+func TestProgressMedia(t *testing.T) {
+	ev := readTestEvent(t, "Event-Name: CHANNEL_PROGRESS_MEDIA\n"+
+		"Caller-Channel-Progress-Media-Time: 1357139041500000\n"+
+		"Caller-Channel-Progress-Time: 0\n\n")
+	if !ev.IsProgressMedia() {
+		t.Error("IsProgressMedia returned false")
+	}
+	ts, err := ev.ProgressMediaTime()
+	if err != nil || !ts.Equal(time.Unix(1357139041, 500000000)) {
+		t.Errorf("ProgressMediaTime returned %v, %v", ts, err)
+	}
+	if ts, err = ev.ProgressTime(); err != nil || !ts.IsZero() {
+		t.Errorf("ProgressTime returned %v, %v, want zero", ts, err)
+	}
+	ev = readTestEvent(t, "Event-Name: CHANNEL_PROGRESS\n\n")
+	if ev.IsProgressMedia() {
+		t.Error("CHANNEL_PROGRESS taken for CHANNEL_PROGRESS_MEDIA")
+	}
+}
+
+func TestMWI(t *testing.T) {
+	ev := readTestEvent(t, "Event-Name: MESSAGE_WAITING\nMWI-Messages-Waiting: yes\n"+
+		"MWI-Message-Account: sip%3A1000%40example.com\nMWI-Voice-Message: 2/5 (1/0)\n\n")
+	mwi, err := ev.MWI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MWIInfo{Account: "sip:1000@example.com", Waiting: true, New: 2, Saved: 5, UrgentNew: 1}
+	if *mwi != want {
+		t.Errorf("MWI returned %+v, want %+v", *mwi, want)
+	}
+	ev = readTestEvent(t, "Event-Name: MESSAGE_WAITING\nMWI-Messages-Waiting: no\n"+
+		"MWI-Voice-Message: 0/3\n\n")
+	if mwi, err = ev.MWI(); err != nil || mwi.Waiting || mwi.Saved != 3 {
+		t.Errorf("MWI returned %+v, %v", mwi, err)
+	}
+}
+
+func TestAudioQuality(t *testing.T) {
+	ev := readTestEvent(t, "Event-Name: CHANNEL_HANGUP_COMPLETE\n"+
+		"variable_rtp_audio_in_mos: 4.50\nvariable_rtp_audio_in_quality_percentage: 100.00\n"+
+		"variable_rtp_audio_in_media_packet_count: 95\nvariable_rtp_audio_in_skip_packet_count: 5\n"+
+		"variable_rtp_audio_in_jitter_min_variance: 0.50\nvariable_rtp_audio_in_jitter_max_variance: 2.25\n\n")
+	q, err := ev.AudioQuality()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := AudioQuality{MOS: 4.5, Quality: 100, Packets: 95, LostPackets: 5,
+		PacketLoss: 5, JitterMin: 0.5, JitterMax: 2.25}
+	if *q != want {
+		t.Errorf("AudioQuality returned %+v, want %+v", *q, want)
+	}
+	ev = readTestEvent(t, "Event-Name: CHANNEL_HANGUP_COMPLETE\nvariable_rtp_audio_in_mos: 4.50\n"+
+		"variable_rtp_audio_in_media_packet_count: many\n\n")
+	if _, err = ev.AudioQuality(); err == nil {
+		t.Error("AudioQuality with an invalid packet count returned no error")
+	}
+	ev = readTestEvent(t, "Event-Name: CHANNEL_HANGUP_COMPLETE\n\n")
+	if _, err = ev.AudioQuality(); err == nil {
+		t.Error("AudioQuality without RTP statistics returned no error")
+	}
+	ev = readTestEvent(t, "Event-Name: CHANNEL_ANSWER\nvariable_rtp_audio_in_mos: 4.50\n\n")
+	if _, err = ev.AudioQuality(); err == nil {
+		t.Error("AudioQuality of a CHANNEL_ANSWER event returned no error")
+	}
+}
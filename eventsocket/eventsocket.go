@@ -18,36 +18,126 @@ package eventsocket
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/textproto"
 	"net/url"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const bufferSize = 1024 << 6 // For the socket reader
 const eventsBuffer = 16      // For the events channel (memory eater!)
+const eventsQueue = 1024     // For the events queue between read and dispatch
 const timeoutPeriod = 60 * time.Second
 
 var errMissingAuthRequest = errors.New("Missing auth request")
 var errInvalidPassword = errors.New("Invalid password")
 var errInvalidCommand = errors.New("Invalid command contains \\r or \\n")
 var errTimeout = errors.New("Timeout")
+var errClosed = errors.New("Connection closed")
+var errHangup = errors.New("Channel hung up")
+var errNotRaw = errors.New("Event was not read in raw events mode")
+var errRateLimited = errors.New("Rate limit exceeded")
+var errTooManyHeaders = errors.New("Too many headers")
+var errDesync = errors.New("Command replies out of sync")
+var errInvalidArg = errors.New("Invalid argument is empty or contains whitespace")
+
+// CommandError is the error returned when the server replies to a command
+// with -ERR. Message is the text that follows -ERR, e.g. "no such channel".
+type CommandError struct {
+	Message string
+}
+
+// newCommandError returns a CommandError for the -ERR reply.
+func newCommandError(reply string) error {
+	return &CommandError{Message: strings.TrimSpace(strings.TrimPrefix(reply, "-ERR"))}
+}
+
+func (e *CommandError) Error() string {
+	return e.Message
+}
+
+// PartialReadError is the error returned when the connection ends in the
+// middle of the body of a frame. Partial is the part of the body that was
+// read.
+type PartialReadError struct {
+	Got, Want int
+	Partial   string
+}
+
+func (e *PartialReadError) Error() string {
+	return fmt.Sprintf("Partial read: got %d of %d bytes", e.Got, e.Want)
+}
+
+// readBody reads a body of length bytes from r, returning a
+// *PartialReadError if r ends before that.
+func readBody(r io.Reader, length int) (string, error) {
+	b := make([]byte, length)
+	n, err := io.ReadFull(r, b)
+	if length > 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+		return "", &PartialReadError{Got: n, Want: length, Partial: string(b[:n])}
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
 
 // Connection is the event socket connection handler.
 type Connection struct {
-	conn          net.Conn
-	reader        *bufio.Reader
-	textreader    *textproto.Reader
-	errEv, errReq chan error
-	cmd, api, evt chan *Event
+	conn       net.Conn
+	reader     *bufio.Reader
+	textreader *textproto.Reader
+	errEv      chan error
+	evt, evq   chan *Event
+	readErr    error
+	wmu        sync.Mutex // Keeps writes in the order of pending
+	submu      sync.Mutex // Serializes SubscribeEvents
+	evqMu      sync.RWMutex
+	evqClosed  bool // Set by readLoop when closing evq
+	srv        *Server
+	network    string // Set by Dial and DialUnix, for Clone
+	addr       string
+	passwd     string
+
+	mu                sync.Mutex
+	rawHeaders        bool
+	splitVariables    bool
+	maxHeaders        int
+	rawEvents         bool
+	closeOnDisconnect bool
+	closing           bool
+	retryable         func(*CommandError) bool
+	alive             bool
+	lastCommand       string
+	eventFormat       string
+	values            map[interface{}]interface{}
+	auditLog          io.Writer
+	slowThreshold     time.Duration
+	slowFunc          func(cmd string, took time.Duration)
+	recordings        map[string]chan *Event
+	subscriptions     map[string]bool
+	subclasses        map[string]bool // CUSTOM subclasses subscribed to
+	defaults          map[string]string
+	jobs              map[string]chan *Event
+	uuidEvents        map[string]*adoption
+	auditMu           sync.Mutex // Serializes writes to auditLog
+	pending           []*waiter
+	lastReply         time.Time
+	rate              int
+	rateBlock         bool
+	tokens            float64
+	lastToken         time.Time
 }
 
 // newConnection allocates a new Connection and initialize its buffers.
@@ -56,15 +146,350 @@ func newConnection(c net.Conn) *Connection {
 		conn:   c,
 		reader: bufio.NewReaderSize(c, bufferSize),
 		errEv:  make(chan error, 1),
-		errReq: make(chan error, 1),
-		cmd:    make(chan *Event),
-		api:    make(chan *Event),
 		evt:    make(chan *Event, eventsBuffer),
+		evq:    make(chan *Event, eventsQueue),
 	}
 	h.textreader = textproto.NewReader(h.reader)
 	return &h
 }
 
+// cmdReply is either the reply to a command, or the error it caused.
+type cmdReply struct {
+	ev  *Event
+	err error
+	api bool // Read from an api/response frame
+}
+
+// waiter receives the reply to a command. FreeSWITCH replies to commands in
+// the order they're sent, so each reply goes to the oldest waiter.
+type waiter struct {
+	ev      chan *Event
+	err     chan error
+	api     bool   // Expects an api/response frame
+	command string // For EventFormat, once accepted
+}
+
+// sendReply delivers a command reply to the oldest pending waiter.
+//
+// As a safety net for the in-order matching, it returns errDesync when the
+// reply can't be for that waiter: when nobody is waiting, or when an api
+// command gets a command/reply or vice versa. Pending waiters then get the
+// error too, since their replies can't be trusted anymore.
+func (h *Connection) sendReply(r cmdReply) error {
+	h.mu.Lock()
+	h.lastReply = time.Now()
+	if len(h.pending) == 0 {
+		h.mu.Unlock()
+		return errDesync
+	}
+	w := h.pending[0]
+	if w.api != r.api {
+		h.mu.Unlock()
+		h.failPending(errDesync)
+		return errDesync
+	}
+	h.pending = h.pending[1:]
+	h.mu.Unlock()
+	// Both channels are buffered, so this never blocks even if the
+	// command timed out and nobody is listening anymore.
+	if r.err != nil {
+		w.err <- r.err
+	} else {
+		h.trackFormat(w.command)
+		h.trackSubscriptions(w.command)
+		w.ev <- r.ev
+	}
+	return nil
+}
+
+// failPending fails all the commands waiting for a reply with err.
+func (h *Connection) failPending(err error) {
+	h.mu.Lock()
+	pending := h.pending
+	h.pending = nil
+	h.mu.Unlock()
+	for _, w := range pending {
+		w.err <- err
+	}
+}
+
+// write sends command, encoded as b, to the server and queues a waiter for
+// its reply, which is an api/response if api is set, or a command/reply
+// otherwise.
+func (h *Connection) write(command string, b []byte, api bool) (*waiter, error) {
+	w := &waiter{
+		ev:      make(chan *Event, 1),
+		err:     make(chan error, 1),
+		api:     api,
+		command: command,
+	}
+	// Writing and queueing must happen atomically, otherwise concurrent
+	// commands could hit the wire in a different order than their
+	// waiters. The waiter is queued first, as the reply may be read
+	// before Write returns.
+	h.wmu.Lock()
+	defer h.wmu.Unlock()
+	h.mu.Lock()
+	if h.closing {
+		// Close already failed the pending commands.
+		h.mu.Unlock()
+		return nil, errClosed
+	}
+	h.pending = append(h.pending, w)
+	h.mu.Unlock()
+	if _, err := h.conn.Write(b); err != nil {
+		h.mu.Lock()
+		for n, p := range h.pending {
+			if p == w {
+				h.pending = append(h.pending[:n], h.pending[n+1:]...)
+				break
+			}
+		}
+		h.mu.Unlock()
+		return nil, err
+	}
+	return w, nil
+}
+
+// SetRawHeaders enables or disables the raw headers mode. In raw mode the
+// headers of incoming events are delivered exactly as received, skipping the
+// capitalize transform. It saves CPU on high-throughput connections whose
+// events are re-serialized elsewhere, but keys such as Unique-ID are no
+// longer normalized for Event.Get.
+func (h *Connection) SetRawHeaders(raw bool) {
+	h.mu.Lock()
+	h.rawHeaders = raw
+	h.mu.Unlock()
+}
+
+// SetSplitVariables enables or disables moving channel variables out of the
+// event headers. When enabled, headers such as variable_sip_call_id are
+// stored in Event.Variables as sip_call_id instead of Event.Header as
+// Variable_sip_call_id. Event.Variable works either way.
+func (h *Connection) SetSplitVariables(split bool) {
+	h.mu.Lock()
+	h.splitVariables = split
+	h.mu.Unlock()
+}
+
+// SetMaxHeaders limits the number of headers of incoming frames and events
+// to max. A peer exceeding the limit is considered broken or malicious, and
+// the connection is closed with an error. A max of zero disables the limit.
+func (h *Connection) SetMaxHeaders(max int) {
+	h.mu.Lock()
+	h.maxHeaders = max
+	h.mu.Unlock()
+}
+
+// headerOpts controls how event headers are parsed and stored, as set by
+// SetRawHeaders, SetSplitVariables and SetMaxHeaders.
+type headerOpts struct {
+	raw       bool
+	splitVars bool
+	max       int
+}
+
+// checkCount returns errTooManyHeaders if n exceeds the limit set by
+// SetMaxHeaders.
+func (opts headerOpts) checkCount(n int) error {
+	if opts.max > 0 && n > opts.max {
+		return errTooManyHeaders
+	}
+	return nil
+}
+
+// SetRawEvents enables or disables the raw events mode. In raw events mode
+// incoming events are not parsed at all, and must be read with ReadRawEvent
+// instead of ReadEvent. Command replies are not affected.
+func (h *Connection) SetRawEvents(raw bool) {
+	h.mu.Lock()
+	h.rawEvents = raw
+	h.mu.Unlock()
+}
+
+// SetCloseOnDisconnect enables or disables the clean shutdown on
+// disconnect-notice. When enabled, receiving a disconnect-notice marks the
+// connection as closing and subsequent calls to Send and SendMsg fail
+// immediately rather than waiting for a reply that will never come.
+//
+// The disconnect-notice itself, and any events that follow it when the
+// connection lingers, are still delivered by ReadEvent.
+func (h *Connection) SetCloseOnDisconnect(on bool) {
+	h.mu.Lock()
+	h.closeOnDisconnect = on
+	h.mu.Unlock()
+}
+
+// SetRetryable sets the function used by SendRetry to decide whether a -ERR
+// reply is worth retrying. When unset, or set to nil, all -ERR replies are
+// retried.
+func (h *Connection) SetRetryable(fn func(*CommandError) bool) {
+	h.mu.Lock()
+	h.retryable = fn
+	h.mu.Unlock()
+}
+
+// SetRateLimit limits the number of commands sent by Send and SendMsg to
+// perSecond, allowing bursts of up to perSecond commands. When the limit is
+// exceeded, commands wait for their turn if block is set, or fail otherwise.
+// A perSecond of zero disables the limit.
+func (h *Connection) SetRateLimit(perSecond int, block bool) {
+	h.mu.Lock()
+	h.rate = perSecond
+	h.rateBlock = block
+	h.tokens = float64(perSecond)
+	h.lastToken = time.Now()
+	h.mu.Unlock()
+}
+
+// throttle takes a token from the rate limiter set by SetRateLimit, waiting
+// for it if necessary.
+func (h *Connection) throttle() error {
+	h.mu.Lock()
+	if h.rate <= 0 {
+		h.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	rate := float64(h.rate)
+	h.tokens += now.Sub(h.lastToken).Seconds() * rate
+	if h.tokens > rate {
+		h.tokens = rate
+	}
+	h.lastToken = now
+	if h.tokens < 1 && !h.rateBlock {
+		h.mu.Unlock()
+		return errRateLimited
+	}
+	// Take the token in advance, leaving the bucket in debt for the
+	// commands that come next while this one waits.
+	wait := time.Duration((1 - h.tokens) / rate * float64(time.Second))
+	h.tokens--
+	h.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return nil
+}
+
+// isClosing returns true if the connection was closed or received a
+// disconnect-notice with SetCloseOnDisconnect enabled.
+func (h *Connection) isClosing() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.closing
+}
+
+// DebugInfo is a snapshot of the state of a Connection, for diagnosing
+// commands that hang.
+type DebugInfo struct {
+	ReadLoopAlive  bool          // False once the connection can't be read
+	LastCommand    string        // Last command sent, e.g. "api status"
+	SinceLastReply time.Duration // Zero if no reply was received yet
+	BufferedEvents int           // Events waiting for ReadEvent
+	Pending        int           // Commands waiting for their reply
+}
+
+// Debug returns a snapshot of the state of the connection.
+func (h *Connection) Debug() DebugInfo {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	info := DebugInfo{
+		ReadLoopAlive:  h.alive,
+		LastCommand:    h.lastCommand,
+		BufferedEvents: len(h.evt) + len(h.evq),
+		Pending:        len(h.pending),
+	}
+	if !h.lastReply.IsZero() {
+		info.SinceLastReply = time.Since(h.lastReply)
+	}
+	return info
+}
+
+// PendingCommands returns the number of commands waiting for their reply,
+// including those whose caller gave up waiting.
+func (h *Connection) PendingCommands() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.pending)
+}
+
+// SetValue attaches value to the connection under key, so application state
+// such as a session ID can travel with it. A nil value removes the key.
+//
+// As with context.WithValue, keys should be of an unexported type of the
+// application to avoid collisions.
+func (h *Connection) SetValue(key, value interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if value == nil {
+		delete(h.values, key)
+		return
+	}
+	if h.values == nil {
+		h.values = make(map[interface{}]interface{})
+	}
+	h.values[key] = value
+}
+
+// Value returns the value attached to the connection under key by SetValue,
+// or nil.
+func (h *Connection) Value(key interface{}) interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.values[key]
+}
+
+// SetAuditLog sets w as the audit log of the connection, where Send and
+// SendMsg append one line per command with its start time, the command,
+// how long it took and its result. A nil w disables the audit log.
+//
+// Example line:
+//
+//	2013-01-02T15:04:05.123Z "api status" 1.2ms ok
+func (h *Connection) SetAuditLog(w io.Writer) {
+	h.mu.Lock()
+	h.auditLog = w
+	h.mu.Unlock()
+}
+
+// SetSlowCommandThreshold sets fn to be called with the commands sent by
+// Send and SendMsg that take longer than d to get their reply. A zero d or
+// nil fn disables it.
+//
+// fn is called synchronously by the goroutine sending the command, so it
+// should not block.
+func (h *Connection) SetSlowCommandThreshold(d time.Duration, fn func(cmd string, took time.Duration)) {
+	h.mu.Lock()
+	h.slowThreshold = d
+	h.slowFunc = fn
+	h.mu.Unlock()
+}
+
+// audit writes a line about the command to the audit log, if set, and
+// reports it to the slow command callback if it took too long.
+func (h *Connection) audit(command string, took time.Duration, err error) {
+	h.mu.Lock()
+	w := h.auditLog
+	slow, slowFunc := h.slowThreshold, h.slowFunc
+	h.mu.Unlock()
+	if slowFunc != nil && slow > 0 && took > slow {
+		slowFunc(command, took)
+	}
+	if w == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "error: " + err.Error()
+	}
+	h.auditMu.Lock()
+	fmt.Fprintf(w, "%s %q %s %s\n",
+		time.Now().Add(-took).UTC().Format(time.RFC3339Nano),
+		command, took, result)
+	h.auditMu.Unlock()
+}
+
 // HandleFunc is the function called on new incoming connections.
 type HandleFunc func(*Connection)
 
@@ -89,19 +514,8 @@ type HandleFunc func(*Connection)
 //	}
 //
 func ListenAndServe(addr string, fn HandleFunc) error {
-	srv, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
-	}
-	for {
-		c, err := srv.Accept()
-		if err != nil {
-			return err
-		}
-		h := newConnection(c)
-		go h.readLoop()
-		go fn(h)
-	}
+	srv := &Server{Addr: addr, Handler: fn}
+	return srv.ListenAndServe()
 }
 
 // Dial attemps to connect to FreeSWITCH and authenticate.
@@ -117,157 +531,328 @@ func ListenAndServe(addr string, fn HandleFunc) error {
 //	}
 //
 func Dial(addr, passwd string) (*Connection, error) {
-	c, err := net.Dial("tcp", addr)
+	return dial("tcp", addr, passwd)
+}
+
+// DialUnix is like Dial, but connects to FreeSWITCH over the Unix domain
+// socket at path.
+func DialUnix(path, passwd string) (*Connection, error) {
+	return dial("unix", path, passwd)
+}
+
+// dial connects to addr on network and authenticates.
+func dial(network, addr, passwd string) (*Connection, error) {
+	c, err := net.Dial(network, addr)
 	if err != nil {
 		return nil, err
 	}
 	h := newConnection(c)
-	m, err := h.textreader.ReadMIMEHeader()
-	if err != nil {
+	if err = authenticate(c, h.textreader, passwd); err != nil {
 		c.Close()
 		return nil, err
 	}
+	h.network, h.addr, h.passwd = network, addr, passwd
+	go h.readLoop()
+	return h, err
+}
+
+// authenticate waits for the auth/request of the server on c, read with r,
+// and answers it with passwd.
+func authenticate(c net.Conn, r *textproto.Reader, passwd string) error {
+	m, err := r.ReadMIMEHeader()
+	if err != nil {
+		return err
+	}
 	if m.Get("Content-Type") != "auth/request" {
-		c.Close()
-		return nil, errMissingAuthRequest
+		return errMissingAuthRequest
 	}
-	fmt.Fprintf(c, "auth %s\r\n\r\n", passwd)
-	m, err = h.textreader.ReadMIMEHeader()
+	if _, err = fmt.Fprintf(c, "auth %s\r\n\r\n", passwd); err != nil {
+		return err
+	}
+	m, err = r.ReadMIMEHeader()
 	if err != nil {
-		c.Close()
-		return nil, err
+		return err
 	}
 	if m.Get("Reply-Text") != "+OK accepted" {
-		c.Close()
-		return nil, errInvalidPassword
+		return errInvalidPassword
 	}
-	go h.readLoop()
-	return h, err
+	return nil
+}
+
+// CheckAuth connects to addr and authenticates with passwd, then closes the
+// connection right away, e.g. to validate credentials. It returns nil if the
+// password was accepted. The whole check is bounded by timeout.
+func CheckAuth(addr, passwd string, timeout time.Duration) error {
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+	return authenticate(c, textproto.NewReader(bufio.NewReader(c)), passwd)
+}
+
+// Clone opens a new connection to the server of h, authenticating with the
+// same password, e.g. to dedicate a connection to events apart from the one
+// used for commands. Only connections made by Dial or DialUnix can be
+// cloned.
+func (h *Connection) Clone() (*Connection, error) {
+	if h.addr == "" {
+		return nil, errors.New("Connection was not made by Dial")
+	}
+	return dial(h.network, h.addr, h.passwd)
+}
+
+// Probe connects to addr and checks whether it's a FreeSWITCH event socket,
+// by reading the auth/request banner, without authenticating. The connection
+// is closed before returning.
+//
+// Services that send something else return false and no error, while
+// network errors and timeouts are returned as they are.
+func Probe(addr string, timeout time.Duration) (bool, error) {
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(timeout))
+	m, err := textproto.NewReader(bufio.NewReader(c)).ReadMIMEHeader()
+	if _, ok := err.(textproto.ProtocolError); ok {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return m.Get("Content-Type") == "auth/request", nil
 }
 
 // readLoop calls readOne until a fatal error occurs, then close the socket.
+//
+// Parsed events are queued for dispatchLoop instead of being delivered
+// directly, so a slow event consumer doesn't hold command replies back until
+// the queue is full.
 func (h *Connection) readLoop() {
-	for h.readOne() {
+	h.mu.Lock()
+	h.alive = true
+	h.mu.Unlock()
+	go h.dispatchLoop()
+	var err error
+	for err == nil {
+		err = h.readOne()
 	}
+	h.mu.Lock()
+	h.alive = false
+	h.mu.Unlock()
 	h.Close()
+	h.readErr = err
+	h.evqMu.Lock()
+	h.evqClosed = true
+	close(h.evq)
+	h.evqMu.Unlock()
+}
+
+// InjectEvent queues ev as if it had been received from the server, so it
+// goes through the same routing and is returned by ReadEvent like any other
+// event. It's meant for testing the event handling of applications. It
+// returns an error once the connection is closed and its events drained.
+func (h *Connection) InjectEvent(ev *Event) error {
+	if ev.Header == nil {
+		ev.Header = make(EventHeader)
+	}
+	h.evqMu.RLock()
+	defer h.evqMu.RUnlock()
+	if h.evqClosed {
+		return errClosed
+	}
+	h.evq <- ev
+	return nil
+}
+
+// dispatchLoop delivers queued events to ReadEvent, followed by the error
+// that terminated readLoop.
+func (h *Connection) dispatchLoop() {
+	for ev := range h.evq {
+		if h.deliverRecording(ev) || h.deliverJob(ev) || h.deliverUUID(ev) {
+			continue
+		}
+		if h.srv != nil && h.srv.deliver(ev) {
+			continue
+		}
+		h.evt <- ev
+	}
+	h.closeWaiters()
+	h.errEv <- h.readErr
+}
+
+// closeWaiters closes the channels of the recordings and jobs still waiting
+// for their event, once the connection is done and nothing can complete
+// them.
+func (h *Connection) closeWaiters() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, stop := range h.recordings {
+		close(stop)
+	}
+	h.recordings = nil
+	for _, job := range h.jobs {
+		close(job)
+	}
+	h.jobs = nil
 }
 
 // readOne reads a single event and send over the appropriate channel.
-// It separates incoming events from api and command responses.
-func (h *Connection) readOne() bool {
+// It separates incoming events from api and command responses: only
+// command/reply and api/response frames are delivered to Send, everything
+// else is queued for ReadEvent. It returns an error only when the connection
+// can't be read anymore.
+func (h *Connection) readOne() error {
 	var (
 		err    error
 		length int
 		hdr    textproto.MIMEHeader
 	)
 
+	h.mu.Lock()
+	opts := headerOpts{
+		raw:       h.rawHeaders,
+		splitVars: h.splitVariables,
+		max:       h.maxHeaders,
+	}
+	rawEvents := h.rawEvents
+	h.mu.Unlock()
+
+	var frame []byte
 	resp := new(Event)
-	hdr, err = h.textreader.ReadMIMEHeader()
+	if rawEvents {
+		frame, hdr, err = readRawFrameHeader(h.reader, opts.max)
+	} else {
+		hdr, err = readHeader(h.textreader, false, opts.max)
+	}
 	if err != nil {
-		h.errEv <- err
-		return false
+		return err
 	}
 
-	resp.Header = make(EventHeader)
+	// Headers are kept in a map, there's no fixed number of them: size it
+	// from the frame, and again from the event below for events.
+	resp.Header = make(EventHeader, len(hdr))
 	if v := hdr.Get("Content-Length"); v != "" {
 		length, err = strconv.Atoi(v)
 		if err == nil {
-			b := make([]byte, length)
-			if _, err = io.ReadFull(h.reader, b); err == nil {
-				resp.Body = string(b)
-			}
+			resp.Body, err = readBody(h.reader, length)
+		}
+	}
+
+	ctype := hdr.Get("Content-Type")
+	if rawEvents && strings.HasPrefix(ctype, "text/") {
+		if err != nil {
+			return err
+		}
+		resp.raw = append(frame, resp.Body...)
+		resp.Body = ""
+		if ctype != "text/disconnect-notice" {
+			h.evq <- resp
+			return nil
 		}
 	}
 
-	switch hdr.Get("Content-Type") {
+	switch ctype {
 	case "command/reply":
 		if err != nil {
-			h.errReq <- err
-			return false
+			h.sendReply(cmdReply{err: err})
+			return err
 		}
 		reply := hdr.Get("Reply-Text")
-		if reply[:2] == "-E" {
-			h.errReq <- errors.New(reply[5:])
-			return true
+		if strings.HasPrefix(reply, "-ERR") {
+			return h.sendReply(cmdReply{err: newCommandError(reply)})
 		}
-		if reply[0] == '%' {
-			copyHeaders(&hdr, resp, true)
+		if strings.HasPrefix(reply, "%") {
+			copyHeaders(&hdr, resp, true, headerOpts{})
 		} else {
-			copyHeaders(&hdr, resp, false)
+			copyHeaders(&hdr, resp, false, headerOpts{})
 		}
-		h.cmd <- resp
+		return h.sendReply(cmdReply{ev: resp})
 	case "api/response":
 		if err != nil {
-			h.errReq <- err
-			return false
+			h.sendReply(cmdReply{err: err, api: true})
+			return err
 		}
-		if string(resp.Body[:2]) == "-E" {
-			h.errReq <- errors.New(string(resp.Body)[5:])
-			return true
+		if strings.HasPrefix(resp.Body, "-ERR") {
+			return h.sendReply(cmdReply{err: newCommandError(resp.Body), api: true})
 		}
-		copyHeaders(&hdr, resp, false)
-		h.api <- resp
+		copyHeaders(&hdr, resp, false, headerOpts{})
+		return h.sendReply(cmdReply{ev: resp, api: true})
 	case "text/event-plain":
 		if err != nil {
-			h.errEv <- err
-			return false
+			return err
 		}
 		reader := bufio.NewReader(bytes.NewReader([]byte(resp.Body)))
 		resp.Body = ""
-		textreader := textproto.NewReader(reader)
-		hdr, err = textreader.ReadMIMEHeader()
+		hdr, err = readHeader(textproto.NewReader(reader), opts.raw, opts.max)
 		if err != nil {
-			h.errEv <- err
-			return false
+			return err
 		}
 		if v := hdr.Get("Content-Length"); v != "" {
 			length, err := strconv.Atoi(v)
 			if err != nil {
-				h.errEv <- err
-				return false
+				return err
 			}
-			b := make([]byte, length)
-			if _, err = io.ReadFull(reader, b); err != nil {
-				h.errEv <- err
-				return false
+			if resp.Body, err = readBody(reader, length); err != nil {
+				return err
 			}
-			resp.Body = string(b)
 		}
-		copyHeaders(&hdr, resp, true)
-		h.evt <- resp
+		resp.Header = make(EventHeader, len(hdr))
+		copyHeaders(&hdr, resp, true, opts)
+		h.evq <- resp
 	case "text/event-json":
 		if err != nil {
-			h.errEv <- err
-			return false
-		}
-		tmp := make(EventHeader)
-		err := json.Unmarshal([]byte(resp.Body), &tmp)
-		if err != nil {
-			h.errEv <- err
-			return false
+			return err
 		}
-		// capitalize header keys for consistency.
-		for k, v := range tmp {
-			resp.Header[capitalize(k)] = v
+		if err = readJSONEvent(resp, opts); err != nil {
+			return err
 		}
-		if v, _ := resp.Header["_body"]; v != nil {
-			resp.Body = v.(string)
+		// The body, if any, comes as the _body key. It's always a
+		// string, anything else is kept as its JSON text.
+		resp.Body = ""
+		if v, ok := resp.Header["_body"]; ok {
+			if s, ok := v.(string); ok {
+				resp.Body = s
+			} else if b, err := json.Marshal(v); err == nil {
+				resp.Body = string(b)
+			}
 			delete(resp.Header, "_body")
-		} else {
-			resp.Body = ""
 		}
-		h.evt <- resp
+		h.evq <- resp
+	case "text/event-xml":
+		if err != nil {
+			return err
+		}
+		if err = readXMLEvent(resp, opts); err != nil {
+			return err
+		}
+		h.evq <- resp
 	case "text/disconnect-notice":
 		if err != nil {
-			h.errEv <- err
-			return false
+			return err
+		}
+		copyHeaders(&hdr, resp, false, headerOpts{})
+		h.mu.Lock()
+		if h.closeOnDisconnect {
+			h.closing = true
+		}
+		h.mu.Unlock()
+		h.evq <- resp
+	case "log/data":
+		// Enabled by the log command, the log line is the body and
+		// its level and origin are in the headers.
+		if err != nil {
+			return err
 		}
-		copyHeaders(&hdr, resp, false)
-		h.evt <- resp
+		copyHeaders(&hdr, resp, false, headerOpts{})
+		h.evq <- resp
 	default:
-		log.Fatal("Unsupported event:", hdr)
+		return textproto.ProtocolError("unsupported content type: " + ctype)
 	}
-	return true
+	return nil
 }
 
 // RemoteAddr returns the remote addr of the connection.
@@ -275,47 +860,266 @@ func (h *Connection) RemoteAddr() net.Addr {
 	return h.conn.RemoteAddr()
 }
 
-// Close terminates the connection.
+// Close terminates the connection. Commands waiting for their reply fail
+// right away with a connection closed error.
 func (h *Connection) Close() {
+	h.mu.Lock()
+	h.closing = true
+	h.mu.Unlock()
 	h.conn.Close()
+	h.failPending(errClosed)
 }
 
-// ReadEvent reads and returns events from the server. It supports both plain
-// or json, but *not* XML.
+// ReadEvent reads and returns events from the server. It supports plain,
+// json and xml events.
 //
 // When subscribing to events (e.g. `Send("events json ALL")`) it makes no
-// difference to use plain or json. ReadEvent will parse them and return
+// difference to use plain, json or xml. ReadEvent will parse them and return
 // all headers and the body (if any) in an Event struct.
 func (h *Connection) ReadEvent() (*Event, error) {
+	return h.readEventContext(context.Background())
+}
+
+// WriteEventsTo reads events and writes them to w as newline delimited JSON,
+// one line per event in the JSON format of FreeSWITCH, e.g. to forward them
+// over another transport. It returns nil when the connection is closed, or
+// the first error reading events or writing to w.
+func (h *Connection) WriteEventsTo(w io.Writer) error {
+	for {
+		ev, err := h.ReadEvent()
+		if err != nil {
+			if err == io.EOF || h.isClosing() {
+				return nil
+			}
+			return err
+		}
+		b, err := ev.marshalJSON()
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+}
+
+// EventStream returns a reader of the events of the connection as newline
+// delimited JSON, as written by WriteEventsTo. The reader returns io.EOF
+// once the connection is closed. Closing the reader stops the forwarding
+// when the next event is read.
+func (h *Connection) EventStream() io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(h.WriteEventsTo(pw))
+	}()
+	return pr
+}
+
+// ReadRawEvent reads and returns the next event exactly as received from
+// the server, headers and body, without parsing it. It requires the raw
+// events mode to be enabled with SetRawEvents.
+func (h *Connection) ReadRawEvent() ([]byte, error) {
+	ev, err := h.ReadEvent()
+	if err != nil {
+		return nil, err
+	}
+	if ev.raw == nil {
+		return nil, errNotRaw
+	}
+	return ev.raw, nil
+}
+
+// readEventContext is like ReadEvent, but gives up when ctx is done.
+func (h *Connection) readEventContext(ctx context.Context) (*Event, error) {
 	var (
 		ev  *Event
 		err error
 	)
+	// Drain pending events before reporting the error that closed the
+	// connection, which is only sent after all of them.
+	select {
+	case ev = <-h.evt:
+		return ev, nil
+	default:
+	}
 	select {
 	case err = <-h.errEv:
 		return nil, err
 	case ev = <-h.evt:
 		return ev, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// readJSONEvent parses the JSON event in resp.Body, moving its headers to
+// resp.Header with capitalized keys for consistency, as copyHeaders does.
+// Headers are counted as they're decoded, so an event with too many of them
+// is rejected before it's all in memory.
+func readJSONEvent(resp *Event, opts headerOpts) error {
+	dec := json.NewDecoder(strings.NewReader(resp.Body))
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	resp.Header = make(EventHeader)
+	for n := 1; dec.More(); n++ {
+		if err := opts.checkCount(n); err != nil {
+			return err
+		}
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		k, _ := t.(string)
+		var v interface{}
+		if err = dec.Decode(&v); err != nil {
+			return err
+		}
+		addHeader(resp, k, v, opts)
+	}
+	return expectDelim(dec, '}')
+}
+
+// readXMLEvent parses the XML event in resp.Body, moving its headers to
+// resp.Header as copyHeaders does, and its body to resp.Body:
+//
+//	<event>
+//	  <headers>
+//	    <Event-Name>CHANNEL_ANSWER</Event-Name>
+//	    ...
+//	  </headers>
+//	  <body>...</body>
+//	</event>
+func readXMLEvent(resp *Event, opts headerOpts) error {
+	var (
+		headers [][2]string
+		path    []string
+		text    bytes.Buffer
+	)
+	dec := xml.NewDecoder(strings.NewReader(resp.Body))
+	resp.Body = ""
+	for {
+		t, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name.Local)
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if len(path) == 3 && path[1] == "headers" {
+				if err = opts.checkCount(len(headers) + 1); err != nil {
+					return err
+				}
+				headers = append(headers, [2]string{t.Name.Local, text.String()})
+			} else if len(path) == 2 && t.Name.Local == "body" {
+				resp.Body = text.String()
+			}
+			path = path[:len(path)-1]
+		}
+	}
+	resp.Header = make(EventHeader, len(headers))
+	for _, kv := range headers {
+		v := kv[1]
+		if s, err := url.QueryUnescape(v); err == nil {
+			v = s
+		}
+		addHeader(resp, kv[0], v, opts)
 	}
+	return nil
 }
 
 // copyHeaders copies all keys and values from the MIMEHeader to Event.Header,
-// normalizing header keys to their capitalized version and values by
-// unescaping them when decode is set to true.
+// normalizing header keys as set by opts and values by unescaping them when
+// decode is set to true.
 //
 // It's used after parsing plain text event headers, but not JSON.
-func copyHeaders(src *textproto.MIMEHeader, dst *Event, decode bool) {
-	var err error
+func copyHeaders(src *textproto.MIMEHeader, dst *Event, decode bool, opts headerOpts) {
 	for k, v := range *src {
-		k = capitalize(k)
+		val := v[0]
 		if decode {
-			dst.Header[k], err = url.QueryUnescape(v[0])
-			if err != nil {
-				dst.Header[k] = v[0]
+			if s, err := url.QueryUnescape(val); err == nil {
+				val = s
 			}
-		} else {
-			dst.Header[k] = v[0]
 		}
+		addHeader(dst, k, val, opts)
+	}
+}
+
+// addHeader adds the header k to the event, capitalizing k unless opts.raw
+// is set, or moving it to Event.Variables if it's a variable and
+// opts.splitVars is set.
+func addHeader(dst *Event, k string, v interface{}, opts headerOpts) {
+	if opts.splitVars && len(k) > 9 && strings.EqualFold(k[:9], "variable_") {
+		if s, ok := v.(string); ok {
+			if dst.Variables == nil {
+				dst.Variables = make(map[string]string)
+			}
+			dst.Variables[k[9:]] = s
+			return
+		}
+	}
+	if !opts.raw {
+		k = capitalize(k)
+	}
+	dst.Header[k] = v
+}
+
+// readRawFrameHeader reads a header block from r like readHeader, and also
+// returns the bytes read.
+func readRawFrameHeader(r *bufio.Reader, max int) ([]byte, textproto.MIMEHeader, error) {
+	var frame []byte
+	for n := 0; ; n++ {
+		if max > 0 && n > max {
+			return frame, nil, errTooManyHeaders
+		}
+		line, err := r.ReadBytes('\n')
+		frame = append(frame, line...)
+		if err != nil {
+			return frame, nil, err
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+	}
+	reader := bufio.NewReader(bytes.NewReader(frame))
+	hdr, err := readHeader(textproto.NewReader(reader), false, 0)
+	return frame, hdr, err
+}
+
+// readHeader reads a header block like textproto.Reader.ReadMIMEHeader. Keys
+// are canonicalized unless raw is set, in which case they're kept exactly as
+// received. It returns errTooManyHeaders as soon as there are more than max
+// headers, unless max is zero, so a broken peer can't make it allocate
+// without limit.
+func readHeader(r *textproto.Reader, raw bool, max int) (textproto.MIMEHeader, error) {
+	m := make(textproto.MIMEHeader)
+	for n := 1; ; n++ {
+		line, err := r.ReadLine()
+		if err != nil {
+			return m, err
+		}
+		if line == "" {
+			return m, nil
+		}
+		if max > 0 && n > max {
+			return m, errTooManyHeaders
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 || strings.TrimSpace(line[:i]) == "" {
+			return m, textproto.ProtocolError("malformed MIME header line: " + line)
+		}
+		k := line[:i]
+		if !raw {
+			k = textproto.CanonicalMIMEHeaderKey(k)
+		}
+		m[k] = append(m[k], strings.Trim(line[i+1:], " \t"))
 	}
 }
 
@@ -323,7 +1127,7 @@ func copyHeaders(src *textproto.MIMEHeader, dst *Event, decode bool) {
 // Headers such as Job-UUID become Job-Uuid and so on. Headers starting with
 // Variable_ only replace ^v with V, and headers staring with _ are ignored.
 func capitalize(s string) string {
-	if s[0] == '_' {
+	if s == "" || s[0] == '_' {
 		return s
 	}
 	ns := bytes.ToLower([]byte(s))
@@ -348,27 +1152,166 @@ func capitalize(s string) string {
 
 // Send sends a single command to the server and returns a response Event.
 //
+// It's safe to call Send, SendMsg and WriteCommand from multiple goroutines:
+// each caller gets the reply to its own command. Send gives up waiting for
+// the reply after a minute.
+//
 // See http://wiki.freeswitch.org/wiki/Event_Socket#Command_Documentation for
 // details.
 func (h *Connection) Send(command string) (*Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutPeriod)
+	defer cancel()
+	ev, err := h.SendContext(ctx, command)
+	if err == context.DeadlineExceeded {
+		err = errTimeout
+	}
+	return ev, err
+}
+
+// SendContext is like Send, but stops waiting for the reply and returns
+// ctx.Err() when ctx is done. The command may still run on the server, and
+// its reply is discarded when it arrives. Unlike Send, it waits for as long
+// as ctx allows.
+func (h *Connection) SendContext(ctx context.Context, command string) (*Event, error) {
 	// Sanity check to avoid breaking the parser
 	//if strings.IndexAny(command, "\r\n") > 0 {
 	//	return nil, errInvalidCommand
 	//}
-	fmt.Fprintf(h.conn, "%s\r\n\r\n", command)
-	var (
-		ev  *Event
-		err error
-	)
-	select {
-	case err = <-h.errReq:
+	start := time.Now()
+	evc, errc, err := h.WriteCommand(command)
+	var ev *Event
+	if err == nil {
+		ev, err = h.readReply(ctx, evc, errc)
+	}
+	h.audit(command, time.Since(start), err)
+	return ev, err
+}
+
+// WriteCommand sends a single command to the server and returns without
+// waiting for the reply. The reply is delivered to either the event or the
+// error channel, each command getting its own pair of channels.
+//
+// It allows for multiple commands in flight, e.g.:
+//
+//	ev1, err1, _ := c.WriteCommand("api status")
+//	ev2, err2, _ := c.WriteCommand("api version")
+//	// both replies are now on their way
+//
+// Replies are matched to commands in the order they're sent, so there's no
+// timeout here: callers that give up on a reply should still leave the
+// channels alone rather than reuse them.
+func (h *Connection) WriteCommand(command string) (<-chan *Event, <-chan error, error) {
+	f := strings.Fields(command)
+	api := len(f) > 0 && strings.EqualFold(f[0], "api")
+	w, err := h.writeCommand(command, []byte(command+"\r\n\r\n"), api)
+	if err != nil {
+		return nil, nil, err
+	}
+	return w.ev, w.err, nil
+}
+
+// writeCommand is the common part of WriteCommand and SendMsg, writing the
+// framed command b unless the connection is closing or rate limited.
+func (h *Connection) writeCommand(command string, b []byte, api bool) (*waiter, error) {
+	if h.isClosing() {
+		return nil, errClosed
+	}
+	if err := h.throttle(); err != nil {
 		return nil, err
-	case ev = <-h.cmd:
-		return ev, nil
-	case ev = <-h.api:
+	}
+	h.setLastCommand(command)
+	return h.write(command, b, api)
+}
+
+// setLastCommand records command for Debug.
+func (h *Connection) setLastCommand(command string) {
+	h.mu.Lock()
+	h.lastCommand = command
+	h.mu.Unlock()
+}
+
+// trackFormat records the event format requested by events and myevents
+// commands, for EventFormat.
+func (h *Connection) trackFormat(command string) {
+	f := strings.Fields(strings.ToLower(command))
+	if len(f) == 0 {
+		return
+	}
+	var format string
+	switch f[0] {
+	case "event", "events":
+		if len(f) > 1 {
+			format = f[1]
+		}
+	case "myevents":
+		// myevents [uuid] [format], plain by default.
+		format = "plain"
+		if last := f[len(f)-1]; last == "json" || last == "xml" {
+			format = last
+		}
+	default:
+		return
+	}
+	switch format {
+	case "plain", "json", "xml":
+		h.mu.Lock()
+		h.eventFormat = format
+		h.mu.Unlock()
+	}
+}
+
+// EventFormat returns the format of the events the connection subscribed to
+// with the last events or myevents command accepted by the server: "plain",
+// "json" or "xml". It returns "" if no such command was accepted.
+func (h *Connection) EventFormat() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.eventFormat
+}
+
+// readReply waits for the reply to a command on its channels, until ctx is
+// done. Events are never delivered here, they're always left for ReadEvent.
+//
+// The channels are buffered, so giving up on a reply never blocks readLoop
+// when it arrives late.
+func (h *Connection) readReply(ctx context.Context, evc <-chan *Event, errc <-chan error) (*Event, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case ev := <-evc:
 		return ev, nil
-	case <-time.After(timeoutPeriod):
-		return nil, errTimeout
+	case err := <-errc:
+		return nil, err
+	}
+}
+
+// readReplyTimeout is like readReply, but gives up with errTimeout after
+// timeoutPeriod.
+func (h *Connection) readReplyTimeout(evc <-chan *Event, errc <-chan error) (*Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutPeriod)
+	defer cancel()
+	ev, err := h.readReply(ctx, evc, errc)
+	if err == context.DeadlineExceeded {
+		err = errTimeout
+	}
+	return ev, err
+}
+
+// SendRetry is like Send, but sends the command again up to attempts times
+// in total, waiting backoff between them, as long as it fails with a -ERR
+// reply that is retryable as defined by SetRetryable. Other errors, such as
+// timeouts, are returned immediately.
+func (h *Connection) SendRetry(command string, attempts int, backoff time.Duration) (*Event, error) {
+	h.mu.Lock()
+	retryable := h.retryable
+	h.mu.Unlock()
+	for n := 1; ; n++ {
+		ev, err := h.Send(command)
+		cerr, ok := err.(*CommandError)
+		if !ok || n >= attempts || (retryable != nil && !retryable(cerr)) {
+			return ev, err
+		}
+		time.Sleep(backoff)
 	}
 }
 
@@ -407,6 +1350,7 @@ func (h *Connection) SendMsg(m MSG, uuid, appData string) (*Event, error) {
 		}
 		b.WriteString(" " + uuid)
 	}
+	cmd := b.String()
 	b.WriteString("\n")
 	for k, v := range m {
 		// Make sure there's no \r or \n in the key, and value.
@@ -424,21 +1368,39 @@ func (h *Connection) SendMsg(m MSG, uuid, appData string) (*Event, error) {
 	if m["content-length"] != "" && appData != "" {
 		b.WriteString(appData)
 	}
-	if _, err := b.WriteTo(h.conn); err != nil {
-		return nil, err
+	start := time.Now()
+	w, err := h.writeCommand(cmd, b.Bytes(), false)
+	var ev *Event
+	if err == nil {
+		ev, err = h.readReplyTimeout(w.ev, w.err)
 	}
-	var (
-		ev  *Event
-		err error
-	)
-	select {
-	case err = <-h.errReq:
+	h.audit(cmd, time.Since(start), err)
+	return ev, err
+}
+
+// SendJSON sends command with payload marshaled to JSON as its body, for
+// modules that take JSON over the event socket, and returns the reply.
+func (h *Connection) SendJSON(command string, payload interface{}) (*Event, error) {
+	if command == "" || strings.IndexAny(command, "\r\n") >= 0 {
+		return nil, errInvalidCommand
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
 		return nil, err
-	case ev = <-h.cmd:
-		return ev, nil
-	case <-time.After(timeoutPeriod):
-		return nil, errTimeout
 	}
+	b := bytes.NewBufferString(command)
+	fmt.Fprintf(b, "\nContent-Type: application/json\nContent-Length: %d\n\n", len(body))
+	b.Write(body)
+	f := strings.Fields(command)
+	api := len(f) > 0 && strings.EqualFold(f[0], "api")
+	start := time.Now()
+	w, err := h.writeCommand(command, b.Bytes(), api)
+	var ev *Event
+	if err == nil {
+		ev, err = h.readReplyTimeout(w.ev, w.err)
+	}
+	h.audit(command, time.Since(start), err)
+	return ev, err
 }
 
 // Execute is a shortcut to SendMsg with call-command: execute without UUID,
@@ -464,6 +1426,41 @@ func (h *Connection) Execute(appName, appArg string, lock bool) (*Event, error)
 	}, "", "")
 }
 
+// ExecuteOpts are the optional sendmsg directives of ExecuteWithOpts.
+type ExecuteOpts struct {
+	Loops     int    // Number of times to run the app, if greater than 1
+	HoldBLeg  bool   // Put the bridged leg on hold while the app runs
+	EventLock bool   // Same as the lock parameter of Execute
+	EventUUID string // Set as Application-UUID in the events of the app
+}
+
+// ExecuteWithOpts is similar to Execute, but takes the additional sendmsg
+// directives in opts.
+//
+// Example:
+//
+//	ExecuteWithOpts("playback", "/tmp/test.wav", ExecuteOpts{Loops: 3})
+//
+// See http://wiki.freeswitch.org/wiki/Event_Socket#execute for details.
+func (h *Connection) ExecuteWithOpts(appName, appArg string, opts ExecuteOpts) (*Event, error) {
+	m := MSG{
+		"call-command":     "execute",
+		"execute-app-name": appName,
+		"execute-app-arg":  appArg,
+		"event-uuid":       opts.EventUUID,
+	}
+	if opts.Loops > 1 {
+		m["loops"] = strconv.Itoa(opts.Loops)
+	}
+	if opts.HoldBLeg {
+		m["hold-bleg"] = "true"
+	}
+	if opts.EventLock {
+		m["event-lock"] = "true"
+	}
+	return h.SendMsg(m, "", "")
+}
+
 // ExecuteUUID is similar to Execute, but takes a UUID and no lock. Suitable
 // for use on inbound event socket connections (acting as client).
 func (h *Connection) ExecuteUUID(uuid, appName, appArg, appUUID string) (*Event, error) {
@@ -475,13 +1472,29 @@ func (h *Connection) ExecuteUUID(uuid, appName, appArg, appUUID string) (*Event,
 	}, uuid, "")
 }
 
+// ExecuteUUIDLock is similar to ExecuteUUID, but also sets event-lock so
+// the application runs after any previous one completes, as the lock
+// parameter of Execute does.
+func (h *Connection) ExecuteUUIDLock(uuid, appName, appArg, appUUID string) (*Event, error) {
+	return h.SendMsg(MSG{
+		"call-command":     "execute",
+		"execute-app-name": appName,
+		"execute-app-arg":  appArg,
+		"event-uuid":       appUUID,
+		"event-lock":       "true",
+	}, uuid, "")
+}
+
 // EventHeader represents events as a pair of key:value.
 type EventHeader map[string]interface{}
 
 // Event represents a FreeSWITCH event.
 type Event struct {
-	Header EventHeader // Event headers, key:val
-	Body   string      // Raw body, available in some events
+	Header    EventHeader       // Event headers, key:val
+	Body      string            // Raw body, available in some events
+	Variables map[string]string // Channel variables, see SetSplitVariables
+
+	raw []byte // The whole frame, in raw events mode
 }
 
 func (r *Event) String() string {
@@ -498,33 +1511,91 @@ func (r *Event) Get(key string) string {
 	if !ok || val == nil {
 		return ""
 	}
-	if s, ok := val.([]string); ok {
-		return strings.Join(s, ", ")
+	switch v := val.(type) {
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, ", ")
 	}
-	return val.(string)
+	return fmt.Sprint(val)
+}
+
+// Variable returns the value of the channel variable name, e.g. sip_call_id,
+// or "" if it's not set. It works whether or not the event was read with
+// SetSplitVariables enabled.
+func (r *Event) Variable(name string) string {
+	if v, ok := r.Variables[name]; ok {
+		return v
+	}
+	if v := r.Get(capitalize("variable_" + name)); v != "" {
+		return v
+	}
+	return r.Get("variable_" + name)
 }
 
 // GetInt returns an Event value converted to int, or an error if conversion
 // is not possible.
 func (r *Event) GetInt(key string) (int, error) {
-	n, err := strconv.Atoi(r.Header[key].(string))
+	n, err := strconv.Atoi(r.Get(key))
 	if err != nil {
 		return 0, err
 	}
 	return n, nil
 }
 
+// GetBool returns an Event value converted to bool, or an error if conversion
+// is not possible. It accepts the same values FreeSWITCH does for booleans:
+// true/false, yes/no, on/off, and 1/0, regardless of case.
+func (r *Event) GetBool(key string) (bool, error) {
+	v := r.Get(key)
+	switch strings.ToLower(v) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("Invalid boolean value %q for %s", v, key)
+}
+
+// marshalJSON returns the event in the JSON format of FreeSWITCH, with the
+// body as _body.
+func (r *Event) marshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(r.Header)+len(r.Variables)+1)
+	for k, v := range r.Header {
+		m[k] = v
+	}
+	for k, v := range r.Variables {
+		m["variable_"+k] = v
+	}
+	if r.Body != "" {
+		m["_body"] = r.Body
+	}
+	return json.Marshal(m)
+}
+
 // PrettyPrint prints Event headers and body to the standard output.
 func (r *Event) PrettyPrint() {
+	r.PrettyPrintTo(os.Stdout, false)
+}
+
+// PrettyPrintTo prints Event headers and body to w. If decoded is set and the
+// body is URL-encoded, the decoded body is printed too, which helps with
+// diagnosing encoding issues.
+func (r *Event) PrettyPrintTo(w io.Writer, decoded bool) {
 	var keys []string
 	for k := range r.Header {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
 	for _, k := range keys {
-		fmt.Printf("%s: %#v\n", k, r.Header[k])
+		fmt.Fprintf(w, "%s: %#v\n", k, r.Header[k])
 	}
 	if r.Body != "" {
-		fmt.Printf("BODY: %#v\n", r.Body)
+		fmt.Fprintf(w, "BODY: %#v\n", r.Body)
+		if decoded {
+			if s, err := url.QueryUnescape(r.Body); err == nil && s != r.Body {
+				fmt.Fprintf(w, "BODY (decoded): %#v\n", s)
+			}
+		}
 	}
 }
@@ -0,0 +1,1214 @@
+// Copyright 2013 Alexandre Fiori
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package eventsocket
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer is the FreeSWITCH end of a connection made by newTestConn.
+type fakeServer struct {
+	t    testing.TB
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newTestConn returns a connection to a fake FreeSWITCH over net.Pipe, with
+// its read loop running. Both ends are closed when the test ends.
+func newTestConn(t testing.TB) (*Connection, *fakeServer) {
+	a, b := net.Pipe()
+	h := newConnection(a)
+	go h.readLoop()
+	t.Cleanup(func() {
+		h.Close()
+		b.Close()
+	})
+	return h, &fakeServer{t: t, conn: b, r: bufio.NewReader(b)}
+}
+
+// listenTest listens on a local TCP port and calls fn with each accepted
+// connection, in a new goroutine. It returns the address to dial.
+func listenTest(t testing.TB, fn func(c net.Conn)) string {
+	return listenTestOn(t, "tcp", "127.0.0.1:0", fn)
+}
+
+// listenTestOn is like listenTest, but listens on addr of network.
+func listenTestOn(t testing.TB, network, addr string, fn func(c net.Conn)) string {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				fn(c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// authServer returns a listenTest handler authenticating clients with
+// passwd, as FreeSWITCH does, then calling fn with the authenticated
+// connection.
+func authServer(passwd string, fn func(s *fakeServer)) func(c net.Conn) {
+	return func(c net.Conn) {
+		s := &fakeServer{conn: c, r: bufio.NewReader(c)}
+		c.Write([]byte("Content-Type: auth/request\n\n"))
+		cmd, err := s.readCommand()
+		if err != nil {
+			return
+		}
+		if cmd != "auth "+passwd {
+			c.Write([]byte(commandReply("-ERR invalid")))
+			return
+		}
+		c.Write([]byte(commandReply("+OK accepted")))
+		if fn != nil {
+			fn(s)
+		}
+	}
+}
+
+// readCommand reads a command sent by the client, and returns its lines
+// joined by "\n", followed by "\n\n" and its body if it has a
+// Content-Length header.
+func (s *fakeServer) readCommand() (string, error) {
+	var (
+		lines  []string
+		length int
+	)
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if f := strings.SplitN(line, ":", 2); len(f) == 2 && strings.EqualFold(f[0], "content-length") {
+			length, _ = strconv.Atoi(strings.TrimSpace(f[1]))
+		}
+		lines = append(lines, line)
+	}
+	cmd := strings.Join(lines, "\n")
+	if length > 0 {
+		body := make([]byte, length)
+		if _, err := io.ReadFull(s.r, body); err != nil {
+			return "", err
+		}
+		cmd += "\n\n" + string(body)
+	}
+	return cmd, nil
+}
+
+// reply reads a command for each of frames and answers it with the frame,
+// in a new goroutine. The commands are sent to the returned channel.
+func (s *fakeServer) reply(frames ...string) <-chan string {
+	cmds := make(chan string, len(frames))
+	go func() {
+		for _, f := range frames {
+			cmd, err := s.readCommand()
+			if err != nil {
+				return
+			}
+			cmds <- cmd
+			if _, err = s.conn.Write([]byte(f)); err != nil {
+				return
+			}
+		}
+	}()
+	return cmds
+}
+
+// send writes frames to the client in a new goroutine.
+func (s *fakeServer) send(frames ...string) {
+	go func() {
+		for _, f := range frames {
+			if _, err := s.conn.Write([]byte(f)); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// command returns the next command received through cmds, failing the test
+// if none comes.
+func command(t *testing.T, cmds <-chan string) string {
+	t.Helper()
+	select {
+	case cmd := <-cmds:
+		return cmd
+	case <-time.After(time.Second):
+		t.Fatal("No command received")
+		return ""
+	}
+}
+
+// msgHeaders returns the first line of the sendmsg command cmd, as returned
+// by readCommand, and its headers.
+func msgHeaders(cmd string) (string, map[string]string) {
+	lines := strings.Split(strings.SplitN(cmd, "\n\n", 2)[0], "\n")
+	m := make(map[string]string)
+	for _, line := range lines[1:] {
+		if f := strings.SplitN(line, ": ", 2); len(f) == 2 {
+			m[f[0]] = f[1]
+		}
+	}
+	return lines[0], m
+}
+
+// apiResponse returns an api/response frame with body.
+func apiResponse(body string) string {
+	return "Content-Type: api/response\nContent-Length: " +
+		strconv.Itoa(len(body)) + "\n\n" + body
+}
+
+// commandReply returns a command/reply frame with the reply text.
+func commandReply(text string) string {
+	return "Content-Type: command/reply\nReply-Text: " + text + "\n\n"
+}
+
+// plainEvent returns a text/event-plain frame of the event text, headers
+// followed by a blank line and its body, if any.
+func plainEvent(text string) string {
+	return "Content-Length: " + strconv.Itoa(len(text)) +
+		"\nContent-Type: text/event-plain\n\n" + text
+}
+
+// readTestEvent parses the plain event text through a connection and
+// returns it.
+func readTestEvent(t *testing.T, text string) *Event {
+	t.Helper()
+	h, s := newTestConn(t)
+	s.send(plainEvent(text))
+	ev, err := h.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ev
+}
+
+func TestRawHeaders(t *testing.T) {
+	h, s := newTestConn(t)
+	h.SetRawHeaders(true)
+	s.send(plainEvent("Event-Name: CUSTOM\nUnique-ID: abc\nvariable_sip_call_id: x%40y\n\n"))
+	ev, err := h.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{
+		"Event-Name":           "CUSTOM",
+		"Unique-ID":            "abc",
+		"variable_sip_call_id": "x@y",
+	} {
+		if v := ev.Get(k); v != want {
+			t.Errorf("Header %s is %q, want %q", k, v, want)
+		}
+	}
+	if _, ok := ev.Header["Unique-Id"]; ok {
+		t.Error("Header key was capitalized in raw mode")
+	}
+}
+
+// frameConn is a net.Conn reading the same frame over and over, for
+// benchmarks.
+type frameConn struct {
+	net.Conn
+	frame []byte
+	off   int
+}
+
+func (c *frameConn) Read(b []byte) (int, error) {
+	n := copy(b, c.frame[c.off:])
+	c.off = (c.off + n) % len(c.frame)
+	return n, nil
+}
+
+// benchmarkEvents measures the parsing of the plain event text by readOne.
+func benchmarkEvents(b *testing.B, text string, setup func(*Connection)) {
+	h := newConnection(&frameConn{frame: []byte(plainEvent(text))})
+	if setup != nil {
+		setup(h)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := h.readOne(); err != nil {
+			b.Fatal(err)
+		}
+		<-h.evq
+	}
+}
+
+// testEventText is a typical CHANNEL_ANSWER event.
+var testEventText = func() string {
+	var b strings.Builder
+	b.WriteString("Event-Name: CHANNEL_ANSWER\nCore-UUID: 8b192020-7368-4498-9b11-cbe10f48a784\n")
+	b.WriteString("Unique-ID: 3b0b5f4e-0fd2-4d3f-8ee8-2f4e3c8b4f21\nChannel-State: CS_EXECUTE\n")
+	for i := 0; i < 40; i++ {
+		b.WriteString("variable_test_var_" + strconv.Itoa(i) + ": value%20" + strconv.Itoa(i) + "\n")
+	}
+	b.WriteString("\n")
+	return b.String()
+}()
+
+func BenchmarkCapitalizedHeaders(b *testing.B) {
+	benchmarkEvents(b, testEventText, nil)
+}
+
+func BenchmarkRawHeaders(b *testing.B) {
+	benchmarkEvents(b, testEventText, func(h *Connection) { h.SetRawHeaders(true) })
+}
+
+func TestCloseOnDisconnect(t *testing.T) {
+	h, s := newTestConn(t)
+	h.SetCloseOnDisconnect(true)
+	body := "Disconnected, goodbye.\nSee you at ClueCon! http://www.cluecon.com/\n"
+	s.send("Content-Type: text/disconnect-notice\nContent-Length: " +
+		strconv.Itoa(len(body)) + "\n\n" + body)
+	ev, err := h.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := ev.Get("Content-Type"); ct != "text/disconnect-notice" {
+		t.Fatalf("Read %s, want the disconnect-notice", ct)
+	}
+	start := time.Now()
+	if _, err = h.Send("api status"); err != errClosed {
+		t.Errorf("Send returned %v, want %v", err, errClosed)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("Send took %v", d)
+	}
+}
+
+func TestSendWhileEventsStream(t *testing.T) {
+	h, s := newTestConn(t)
+	ev := plainEvent("Event-Name: HEARTBEAT\n\n")
+	go func() {
+		if _, err := s.readCommand(); err != nil {
+			return
+		}
+		for i := 0; i < eventsBuffer/2; i++ {
+			s.conn.Write([]byte(ev))
+		}
+		s.conn.Write([]byte(apiResponse("UP 0 years\n")))
+		for i := 0; i < eventsBuffer/2; i++ {
+			s.conn.Write([]byte(ev))
+		}
+	}()
+	reply, err := h.Send("api status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Body != "UP 0 years\n" {
+		t.Errorf("Send returned %q", reply.Body)
+	}
+	for i := 0; i < eventsBuffer; i++ {
+		ev, err := h.ReadEvent()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Get("Event-Name") != "HEARTBEAT" {
+			t.Fatalf("Event %d is %v", i, ev)
+		}
+	}
+}
+
+// BenchmarkSendUnderEvents measures the latency of commands whose reply
+// comes after a burst of events, read by a consumer slower than the server.
+func BenchmarkSendUnderEvents(b *testing.B) {
+	h, s := newTestConn(b)
+	ev := []byte(plainEvent(testEventText))
+	reply := []byte(apiResponse("+OK\n"))
+	go func() {
+		for {
+			if _, err := s.readCommand(); err != nil {
+				return
+			}
+			for i := 0; i < 100; i++ {
+				s.conn.Write(ev)
+			}
+			s.conn.Write(reply)
+		}
+	}()
+	go func() {
+		for {
+			if _, err := h.ReadEvent(); err != nil {
+				return
+			}
+			time.Sleep(time.Microsecond)
+		}
+	}()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := h.Send("api status"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSendRetry(t *testing.T) {
+	h, s := newTestConn(t)
+	h.SetRetryable(func(err *CommandError) bool {
+		return err.Message == "Busy"
+	})
+	cmds := s.reply(apiResponse("-ERR Busy\n"), apiResponse("+OK\n"),
+		apiResponse("-ERR No such channel\n"))
+	ev, err := h.SendRetry("api status", 3, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Body != "+OK\n" {
+		t.Errorf("SendRetry returned %q", ev.Body)
+	}
+	command(t, cmds)
+	command(t, cmds)
+	_, err = h.SendRetry("api status", 3, time.Millisecond)
+	if cerr, ok := err.(*CommandError); !ok || cerr.Message != "No such channel" {
+		t.Errorf("SendRetry returned %v", err)
+	}
+	command(t, cmds)
+	if n := h.PendingCommands(); n != 0 {
+		t.Errorf("%d commands sent after a non-retryable error", n)
+	}
+}
+
+func TestDebug(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("+OK\n"))
+	if _, err := h.Send("api status"); err != nil {
+		t.Fatal(err)
+	}
+	command(t, cmds)
+	info := h.Debug()
+	if !info.ReadLoopAlive || info.LastCommand != "api status" || info.Pending != 0 {
+		t.Errorf("Debug returned %+v", info)
+	}
+	s.conn.Close()
+	if _, err := h.ReadEvent(); err == nil {
+		t.Fatal("ReadEvent returned no error after the connection closed")
+	}
+	if h.Debug().ReadLoopAlive {
+		t.Error("Read loop still alive after the connection closed")
+	}
+}
+
+func TestExecuteWithOpts(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(commandReply("+OK"))
+	_, err := h.ExecuteWithOpts("playback", "/tmp/test.wav", ExecuteOpts{
+		Loops:     3,
+		HoldBLeg:  true,
+		EventUUID: "app1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, m := msgHeaders(command(t, cmds))
+	if first != "sendmsg" {
+		t.Errorf("Sent %q", first)
+	}
+	for k, want := range map[string]string{
+		"call-command":     "execute",
+		"execute-app-name": "playback",
+		"execute-app-arg":  "/tmp/test.wav",
+		"loops":            "3",
+		"hold-bleg":        "true",
+		"event-uuid":       "app1",
+		"event-lock":       "",
+	} {
+		if m[k] != want {
+			t.Errorf("Header %s is %q, want %q", k, m[k], want)
+		}
+	}
+}
+
+func TestReadRawEvent(t *testing.T) {
+	h, s := newTestConn(t)
+	h.SetRawEvents(true)
+	frame := plainEvent("Event-Name: CUSTOM\nUnique-ID: abc\n\n")
+	s.send(frame)
+	b, err := h.ReadRawEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != frame {
+		t.Errorf("ReadRawEvent returned %q, want %q", b, frame)
+	}
+
+	h, s = newTestConn(t)
+	s.send(frame)
+	if _, err = h.ReadRawEvent(); err != errNotRaw {
+		t.Errorf("ReadRawEvent without raw events returned %v", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	h, s := newTestConn(t)
+	h.SetRateLimit(2, true)
+	frames := make([]string, 5)
+	for i := range frames {
+		frames[i] = apiResponse("+OK\n")
+	}
+	s.reply(frames...)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := h.Send("api status"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Two commands go right away, the next three wait half a second each.
+	if d := time.Since(start); d < 1400*time.Millisecond || d > 2*time.Second {
+		t.Errorf("Sending 5 commands at 2/s took %v", d)
+	}
+
+	h.SetRateLimit(1, false)
+	s.reply(apiResponse("+OK\n"))
+	if _, err := h.Send("api status"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Send("api status"); err != errRateLimited {
+		t.Errorf("Send over the limit returned %v", err)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	addr := listenTest(t, func(c net.Conn) {
+		c.Write([]byte("Content-Type: auth/request\n\n"))
+		bufio.NewReader(c).ReadString('\n')
+	})
+	if ok, err := Probe(addr, time.Second); !ok || err != nil {
+		t.Errorf("Probe of an event socket returned %v, %v", ok, err)
+	}
+	addr = listenTest(t, func(c net.Conn) {
+		c.Write([]byte("SSH-2.0-OpenSSH_7.4\r\n\r\n"))
+	})
+	if ok, err := Probe(addr, time.Second); ok || err != nil {
+		t.Errorf("Probe of another service returned %v, %v", ok, err)
+	}
+}
+
+func TestWriteCommandInterleaved(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("UP\n"), apiResponse("FreeSWITCH 1.10\n"))
+	ev1, err1, err := h.WriteCommand("api status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev2, err2, err := h.WriteCommand("api version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd := command(t, cmds); cmd != "api status" {
+		t.Errorf("Sent %q first", cmd)
+	}
+	// Read the second reply first.
+	for _, r := range []struct {
+		ev   <-chan *Event
+		err  <-chan error
+		want string
+	}{
+		{ev2, err2, "FreeSWITCH 1.10\n"},
+		{ev1, err1, "UP\n"},
+	} {
+		select {
+		case ev := <-r.ev:
+			if ev.Body != r.want {
+				t.Errorf("Got %q, want %q", ev.Body, r.want)
+			}
+		case err := <-r.err:
+			t.Errorf("Got %v, want %q", err, r.want)
+		case <-time.After(time.Second):
+			t.Fatalf("No reply %q", r.want)
+		}
+	}
+}
+
+func TestConcurrentSend(t *testing.T) {
+	h, s := newTestConn(t)
+	const n = 50
+	// Echo each command back, with events in between.
+	go func() {
+		for {
+			cmd, err := s.readCommand()
+			if err != nil {
+				return
+			}
+			s.conn.Write([]byte(plainEvent("Event-Name: HEARTBEAT\n\n")))
+			s.conn.Write([]byte(apiResponse(cmd)))
+		}
+	}()
+	go func() {
+		for {
+			if _, err := h.ReadEvent(); err != nil {
+				return
+			}
+		}
+	}()
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			cmd := "api echo " + strconv.Itoa(i)
+			ev, err := h.Send(cmd)
+			if err == nil && ev.Body != cmd {
+				err = fmt.Errorf("%q got the reply to %q", cmd, ev.Body)
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestExecuteUUIDLock(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(commandReply("+OK"))
+	if _, err := h.ExecuteUUIDLock("abc", "playback", "/tmp/test.wav", "app1"); err != nil {
+		t.Fatal(err)
+	}
+	first, m := msgHeaders(command(t, cmds))
+	if first != "sendmsg abc" {
+		t.Errorf("Sent %q", first)
+	}
+	if m["event-lock"] != "true" || m["event-uuid"] != "app1" || m["execute-app-name"] != "playback" {
+		t.Errorf("Sent headers %v", m)
+	}
+}
+
+func TestPartialRead(t *testing.T) {
+	h, s := newTestConn(t)
+	go func() {
+		s.readCommand()
+		s.conn.Write([]byte("Content-Type: api/response\nContent-Length: 100\n\ntruncated"))
+		s.conn.Close()
+	}()
+	_, err := h.Send("api status")
+	perr, ok := err.(*PartialReadError)
+	if !ok {
+		t.Fatalf("Send returned %v", err)
+	}
+	if perr.Got != 9 || perr.Want != 100 || perr.Partial != "truncated" {
+		t.Errorf("Got %+v", perr)
+	}
+}
+
+func TestEventFormat(t *testing.T) {
+	h, s := newTestConn(t)
+	if f := h.EventFormat(); f != "" {
+		t.Errorf("EventFormat before subscribing is %q", f)
+	}
+	for _, tc := range []struct{ cmd, reply, want string }{
+		{"events json ALL", commandReply("+OK"), "json"},
+		{"myevents", commandReply("+OK"), "plain"},
+		{"myevents abc xml", commandReply("+OK"), "xml"},
+		{"event plain CHANNEL_ANSWER", commandReply("+OK"), "plain"},
+		{"api status", apiResponse("UP\n"), "plain"},
+	} {
+		cmds := s.reply(tc.reply)
+		if _, err := h.Send(tc.cmd); err != nil {
+			t.Fatal(err)
+		}
+		command(t, cmds)
+		if f := h.EventFormat(); f != tc.want {
+			t.Errorf("EventFormat after %q is %q, want %q", tc.cmd, f, tc.want)
+		}
+	}
+
+	// A rejected events command doesn't change the format.
+	cmds := s.reply(commandReply("-ERR invalid"))
+	if _, err := h.Send("events xml ALL"); err == nil {
+		t.Fatal("Send of a rejected events command returned no error")
+	}
+	command(t, cmds)
+	if f := h.EventFormat(); f != "plain" {
+		t.Errorf("EventFormat after a rejected events command is %q", f)
+	}
+}
+
+func TestMaxHeaders(t *testing.T) {
+	jsonBody := `{"Event-Name":"CUSTOM","A":"1","B":"2","C":"3"}`
+	xmlBody := "<event><headers><Event-Name>CUSTOM</Event-Name><A>1</A><B>2</B>" +
+		"<C>3</C></headers></event>"
+	for _, tc := range []struct {
+		name  string
+		frame string
+		raw   bool
+	}{
+		{"frame", "Content-Type: text/event-plain\nA: 1\nB: 2\nC: 3\n\n", false},
+		{"raw frame", "Content-Type: text/event-plain\nA: 1\nB: 2\nC: 3\n\n", true},
+		{"plain", plainEvent("Event-Name: CUSTOM\nA: 1\nB: 2\nC: 3\n\n"), false},
+		{"json", "Content-Length: " + strconv.Itoa(len(jsonBody)) +
+			"\nContent-Type: text/event-json\n\n" + jsonBody, false},
+		{"xml", "Content-Length: " + strconv.Itoa(len(xmlBody)) +
+			"\nContent-Type: text/event-xml\n\n" + xmlBody, false},
+	} {
+		h, s := newTestConn(t)
+		h.SetMaxHeaders(3)
+		h.SetRawEvents(tc.raw)
+		s.send(tc.frame)
+		if _, err := h.ReadEvent(); err != errTooManyHeaders {
+			t.Errorf("ReadEvent of a %s with too many headers returned %v", tc.name, err)
+		}
+	}
+
+	h, s := newTestConn(t)
+	h.SetMaxHeaders(3)
+	s.send(plainEvent("Event-Name: CUSTOM\nA: 1\nB: 2\n\n"))
+	if _, err := h.ReadEvent(); err != nil {
+		t.Errorf("ReadEvent of an event at the limit returned %v", err)
+	}
+}
+
+func TestReadHeaderEmptyKey(t *testing.T) {
+	for _, text := range []string{": x\n\n", " \t: x\n\n"} {
+		r := textproto.NewReader(bufio.NewReader(strings.NewReader(text)))
+		if _, err := readHeader(r, false, 0); err == nil {
+			t.Errorf("readHeader of %q returned no error", text)
+		} else if _, ok := err.(textproto.ProtocolError); !ok {
+			t.Errorf("readHeader of %q returned %v", text, err)
+		}
+	}
+
+	// It's an error for the connection, rather than a panic.
+	h, s := newTestConn(t)
+	s.send(plainEvent("Event-Name: CUSTOM\n: x\n\n"))
+	if _, err := h.ReadEvent(); err == nil {
+		t.Error("ReadEvent of a header without a key returned no error")
+	}
+	if capitalize("") != "" {
+		t.Error("capitalize of an empty key isn't empty")
+	}
+}
+
+func TestReadHeaderLimit(t *testing.T) {
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(
+		strings.Repeat("A: 1\n", 1000) + "\n")))
+	m, err := readHeader(r, false, 10)
+	if err != errTooManyHeaders {
+		t.Fatalf("readHeader returned %v", err)
+	}
+	if n := len(m["A"]); n > 10 {
+		t.Errorf("readHeader kept %d headers past the limit", n)
+	}
+}
+
+func TestUnexpectedReply(t *testing.T) {
+	h, s := newTestConn(t)
+	s.send(apiResponse("+OK\n"))
+	// The read loop gives up on the connection.
+	if _, err := h.ReadEvent(); err != errDesync {
+		t.Errorf("ReadEvent after an unexpected reply returned %v", err)
+	}
+
+	h, s = newTestConn(t)
+	cmds := s.reply(commandReply("+OK"))
+	if _, err := h.Send("api status"); err != errDesync {
+		t.Errorf("Send of an api command got %v for a command/reply", err)
+	}
+	command(t, cmds)
+}
+
+func TestValue(t *testing.T) {
+	type key struct{}
+	h, _ := newTestConn(t)
+	if v := h.Value(key{}); v != nil {
+		t.Errorf("Value before SetValue is %v", v)
+	}
+	h.SetValue(key{}, "session-1")
+	if v := h.Value(key{}); v != "session-1" {
+		t.Errorf("Value is %v", v)
+	}
+	h.SetValue(key{}, nil)
+	if v := h.Value(key{}); v != nil {
+		t.Errorf("Value after removal is %v", v)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	h, s := newTestConn(t)
+	var b strings.Builder
+	h.SetAuditLog(&b)
+	cmds := s.reply(apiResponse("UP\n"), apiResponse("-ERR no such command\n"))
+	if _, err := h.Send("api status"); err != nil {
+		t.Fatal(err)
+	}
+	command(t, cmds)
+	if _, err := h.Send("api nope"); err == nil {
+		t.Fatal("Send returned no error")
+	}
+	command(t, cmds)
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Audit log has %d lines: %q", len(lines), b.String())
+	}
+	for n, want := range []string{`"api status" `, `"api nope" `} {
+		if !strings.Contains(lines[n], want) {
+			t.Errorf("Line %d is %q, want the command %s", n, lines[n], want)
+		}
+	}
+	if !strings.HasSuffix(lines[0], " ok") {
+		t.Errorf("Line of a success is %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], " error: no such command") {
+		t.Errorf("Line of a failure is %q", lines[1])
+	}
+}
+
+func TestPrettyPrintTo(t *testing.T) {
+	ev := &Event{
+		Header: EventHeader{"Event-Name": "CUSTOM", "Unique-Id": "abc"},
+		Body:   "hello%20world",
+	}
+	var b strings.Builder
+	ev.PrettyPrintTo(&b, false)
+	want := "Event-Name: \"CUSTOM\"\nUnique-Id: \"abc\"\nBODY: \"hello%20world\"\n"
+	if b.String() != want {
+		t.Errorf("Raw form is %q, want %q", b.String(), want)
+	}
+	b.Reset()
+	ev.PrettyPrintTo(&b, true)
+	want += "BODY (decoded): \"hello world\"\n"
+	if b.String() != want {
+		t.Errorf("Decoded form is %q, want %q", b.String(), want)
+	}
+}
+
+func TestManyHeaders(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("Event-Name: CUSTOM\n")
+	for i := 0; i < 300; i++ {
+		b.WriteString("X-Header-" + strconv.Itoa(i) + ": " + strconv.Itoa(i) + "\n")
+	}
+	b.WriteString("\n")
+	ev := readTestEvent(t, b.String())
+	if n := len(ev.Header); n != 301 {
+		t.Errorf("Event has %d headers, want 301", n)
+	}
+	if v := ev.Get("X-Header-299"); v != "299" {
+		t.Errorf("Last header is %q", v)
+	}
+}
+
+func TestCustomHeaders(t *testing.T) {
+	ev := readTestEvent(t, "Event-Name: CUSTOM\nEvent-Subclass: myapp::status\n"+
+		"MyApp-Queue: sales\nvariable_myapp_agent: 1000\n\n")
+	if v := ev.Get("Myapp-Queue"); v != "sales" {
+		t.Errorf("Custom header is %q", v)
+	}
+	if v := ev.Variable("myapp_agent"); v != "1000" {
+		t.Errorf("Custom variable is %q", v)
+	}
+}
+
+func TestSlowCommandThreshold(t *testing.T) {
+	h, s := newTestConn(t)
+	var slow []string
+	h.SetSlowCommandThreshold(20*time.Millisecond, func(cmd string, took time.Duration) {
+		if took <= 20*time.Millisecond {
+			t.Errorf("%q reported slow after %v", cmd, took)
+		}
+		slow = append(slow, cmd)
+	})
+	go func() {
+		for _, delay := range []time.Duration{0, 50 * time.Millisecond} {
+			if _, err := s.readCommand(); err != nil {
+				return
+			}
+			time.Sleep(delay)
+			s.conn.Write([]byte(apiResponse("+OK\n")))
+		}
+	}()
+	for _, cmd := range []string{"api fast", "api slow"} {
+		if _, err := h.Send(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(slow) != 1 || slow[0] != "api slow" {
+		t.Errorf("Slow commands are %q", slow)
+	}
+}
+
+func TestCloseWhileSending(t *testing.T) {
+	h, s := newTestConn(t)
+	// Read the command and never reply.
+	cmds := s.reply("")
+	errc := make(chan error, 1)
+	go func() {
+		_, err := h.Send("api status")
+		errc <- err
+	}()
+	command(t, cmds)
+	start := time.Now()
+	h.Close()
+	select {
+	case err := <-errc:
+		if err != errClosed {
+			t.Errorf("Send returned %v, want %v", err, errClosed)
+		}
+		if d := time.Since(start); d > 100*time.Millisecond {
+			t.Errorf("Send returned %v after Close", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Send still blocked after Close")
+	}
+}
+
+func TestHeaderValueWithColon(t *testing.T) {
+	ev := readTestEvent(t, "Event-Name: CUSTOM\nX-Uri: sip:1000@1.2.3.4:5060|x:y\n\n")
+	if v := ev.Get("X-Uri"); v != "sip:1000@1.2.3.4:5060|x:y" {
+		t.Errorf("Header is %q", v)
+	}
+}
+
+func BenchmarkCustomHeaders(b *testing.B) {
+	var s strings.Builder
+	s.WriteString("Event-Name: CUSTOM\nEvent-Subclass: myapp::status\n")
+	for i := 0; i < 200; i++ {
+		s.WriteString("X-Custom-" + strconv.Itoa(i) + ": a:b|c:" + strconv.Itoa(i) + "\n")
+	}
+	s.WriteString("\n")
+	benchmarkEvents(b, s.String(), nil)
+}
+
+func TestSendJSON(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(commandReply("+OK"))
+	payload := map[string]string{"command": "fs_status", "data": "héllo"}
+	if _, err := h.SendJSON("json", payload); err != nil {
+		t.Fatal(err)
+	}
+	cmd := command(t, cmds)
+	f := strings.SplitN(cmd, "\n\n", 2)
+	if len(f) != 2 {
+		t.Fatalf("Sent %q without body", cmd)
+	}
+	_, m := msgHeaders(f[0])
+	if m["Content-Type"] != "application/json" {
+		t.Errorf("Content-Type is %q", m["Content-Type"])
+	}
+	if n, _ := strconv.Atoi(m["Content-Length"]); n != len(f[1]) {
+		t.Errorf("Content-Length is %d, body is %d bytes", n, len(f[1]))
+	}
+	if want := `{"command":"fs_status","data":"héllo"}`; f[1] != want {
+		t.Errorf("Body is %s, want %s", f[1], want)
+	}
+}
+
+func TestClone(t *testing.T) {
+	conns := make(chan *fakeServer, 2)
+	done := make(chan struct{})
+	defer close(done)
+	addr := listenTest(t, authServer("ClueCon", func(s *fakeServer) {
+		conns <- s
+		<-done
+	}))
+	h, err := Dial(addr, "ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	c, err := h.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	<-conns
+	s := <-conns
+	cmds := s.reply(apiResponse("UP\n"))
+	if _, err = c.Send("api status"); err != nil {
+		t.Fatal(err)
+	}
+	command(t, cmds)
+
+	h, _ = newTestConn(t)
+	if _, err = h.Clone(); err == nil {
+		t.Error("Clone of a connection not made by Dial returned no error")
+	}
+}
+
+func TestDialUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventsocket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := listenTestOn(t, "unix", filepath.Join(dir, "esl.sock"), authServer("ClueCon", func(s *fakeServer) {
+		if cmd, err := s.readCommand(); err == nil && cmd == "api status" {
+			s.conn.Write([]byte(apiResponse("UP\n")))
+		}
+	}))
+	if _, err = DialUnix(path, "wrong"); err == nil {
+		t.Error("DialUnix with a wrong password returned no error")
+	}
+	h, err := DialUnix(path, "ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ev, err := h.Send("api status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Body != "UP\n" {
+		t.Errorf("Send returned %q", ev.Body)
+	}
+}
+
+func TestInjectEvent(t *testing.T) {
+	h, s := newTestConn(t)
+	evc := h.EventsForUUID("abc")
+	if err := h.InjectEvent(&Event{Header: EventHeader{"Event-Name": "CHANNEL_ANSWER", "Unique-Id": "abc"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.InjectEvent(&Event{Header: EventHeader{"Event-Name": "HEARTBEAT"}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-evc:
+		if ev.Name() != "CHANNEL_ANSWER" {
+			t.Errorf("Got %v for abc", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Injected event not routed by UUID")
+	}
+	ev, err := h.ReadEvent()
+	if err != nil || ev.Name() != "HEARTBEAT" {
+		t.Errorf("ReadEvent returned %v, %v", ev, err)
+	}
+	s.conn.Close()
+	if _, err = h.ReadEvent(); err == nil {
+		t.Fatal("ReadEvent returned no error after the connection closed")
+	}
+	if err = h.InjectEvent(&Event{}); err != errClosed {
+		t.Errorf("InjectEvent after close returned %v", err)
+	}
+}
+
+func TestPendingCommands(t *testing.T) {
+	h, s := newTestConn(t)
+	done := make(chan error, 1)
+	go func() {
+		_, err := h.Send("api status")
+		done <- err
+	}()
+	if _, err := s.readCommand(); err != nil {
+		t.Fatal(err)
+	}
+	if n := h.PendingCommands(); n != 1 {
+		t.Errorf("PendingCommands returned %d while waiting for the reply", n)
+	}
+	s.send(apiResponse("UP\n"))
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := h.PendingCommands(); n != 0 {
+		t.Errorf("PendingCommands returned %d after the reply", n)
+	}
+}
+
+func TestCRLFHeaders(t *testing.T) {
+	text := "Event-Name: CUSTOM\nUnique-ID: abc\nvariable_sip_call_id: x%40y\n" +
+		"Content-Length: 6\n\nhello\n"
+	crlf := strings.Replace(text[:strings.Index(text, "\n\n")+2], "\n", "\r\n", -1) + "hello\n"
+	for _, raw := range []bool{false, true} {
+		h, s := newTestConn(t)
+		h.SetRawHeaders(raw)
+		s.send(plainEvent(text), "Content-Length: "+strconv.Itoa(len(crlf))+
+			"\r\nContent-Type: text/event-plain\r\n\r\n"+crlf)
+		want, err := h.ReadEvent()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want.Body != "hello\n" || len(want.Header) != 4 {
+			t.Fatalf("ReadEvent returned %#v", want)
+		}
+		ev, err := h.ReadEvent()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ev, want) {
+			t.Errorf("CRLF event is %#v, want %#v (raw headers %v)", ev, want, raw)
+		}
+	}
+}
+
+func TestJSONEvent(t *testing.T) {
+	h, s := newTestConn(t)
+	var frames []string
+	for _, body := range []string{
+		`{"Event-Name":"CUSTOM","Unique-ID":"abc","Event-Subclass":"sofia::register","_body":"hello\n"}`,
+		`{"Event-Name":"CUSTOM","Count":3,"":"x","_body":{"a":1}}`,
+	} {
+		frames = append(frames, "Content-Length: "+strconv.Itoa(len(body))+
+			"\nContent-Type: text/event-json\n\n"+body)
+	}
+	s.send(frames...)
+	ev, err := h.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Body != "hello\n" {
+		t.Errorf("Body is %q", ev.Body)
+	}
+	if ev.Get("Unique-Id") != "abc" || ev.Get("Event-Subclass") != "sofia::register" {
+		t.Errorf("ReadEvent returned headers %v", ev.Header)
+	}
+	if _, ok := ev.Header["_body"]; ok {
+		t.Error("_body was kept as a header")
+	}
+
+	// A _body that isn't a string is kept as its JSON text, and other
+	// values that aren't strings don't trip Get.
+	ev, err = h.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Body != `{"a":1}` || ev.Get("_body") != "" {
+		t.Errorf("ReadEvent returned %#v", ev)
+	}
+	if v := ev.Get("Count"); v != "3" {
+		t.Errorf("Count is %q", v)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	h, s := newTestConn(t)
+	go func() {
+		s.conn.Write([]byte(plainEvent("Event-Name: CHANNEL_ANSWER\nUnique-ID: abc\n\n") +
+			plainEvent("Event-Name: CUSTOM\nContent-Length: 6\n\nhello\n")))
+		s.conn.Close()
+	}()
+	r := h.EventStream()
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("EventStream returned %q", b)
+	}
+	for n, want := range []map[string]string{
+		{"Event-Name": "CHANNEL_ANSWER", "Unique-Id": "abc"},
+		{"Event-Name": "CUSTOM", "_body": "hello\n"},
+	} {
+		var m map[string]string
+		if err = json.Unmarshal([]byte(lines[n]), &m); err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range want {
+			if m[k] != v {
+				t.Errorf("Line %d has %s %q, want %q", n+1, k, m[k], v)
+			}
+		}
+	}
+}
+
+func TestXMLEvent(t *testing.T) {
+	xmlBody := "<event>\n  <headers>\n    <Event-Name>CHANNEL_ANSWER</Event-Name>\n" +
+		"    <Unique-ID>abc</Unique-ID>\n    <Caller-Caller-ID-Name>John%20Doe</Caller-Caller-ID-Name>\n" +
+		"    <variable_sip_call_id>x%40y</variable_sip_call_id>\n  </headers>\n</event>"
+	h, s := newTestConn(t)
+	s.send(
+		plainEvent("Event-Name: CHANNEL_ANSWER\nUnique-ID: abc\nCaller-Caller-ID-Name: John%20Doe\n"+
+			"variable_sip_call_id: x%40y\n\n"),
+		"Content-Length: "+strconv.Itoa(len(xmlBody))+"\nContent-Type: text/event-xml\n\n"+xmlBody,
+	)
+	want, err := h.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev, err := h.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ev, want) {
+		t.Errorf("XML event is %#v, want %#v", ev, want)
+	}
+	if ev.Get("Caller-Caller-Id-Name") != "John Doe" {
+		t.Errorf("Caller name is %q", ev.Get("Caller-Caller-Id-Name"))
+	}
+}
+
+func TestCheckAuth(t *testing.T) {
+	closed := make(chan error, 1)
+	addr := listenTest(t, func(c net.Conn) {
+		authServer("ClueCon", nil)(c)
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := c.Read(make([]byte, 1))
+		closed <- err
+	})
+	for _, tc := range []struct {
+		passwd string
+		want   error
+	}{
+		{"ClueCon", nil},
+		{"wrong", errInvalidPassword},
+	} {
+		if err := CheckAuth(addr, tc.passwd, time.Second); err != tc.want {
+			t.Errorf("CheckAuth with password %q returned %v, want %v", tc.passwd, err, tc.want)
+		}
+		if err := <-closed; err != io.EOF {
+			t.Errorf("Connection not closed by CheckAuth with password %q: %v", tc.passwd, err)
+		}
+	}
+}
+
+func TestSendContextCancel(t *testing.T) {
+	h, s := newTestConn(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := h.SendContext(ctx, "api status")
+		done <- err
+	}()
+	if _, err := s.readCommand(); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("SendContext returned %v", err)
+	}
+
+	// The late reply is discarded, and the next command gets its own.
+	if _, err := s.conn.Write([]byte(apiResponse("first\n"))); err != nil {
+		t.Fatal(err)
+	}
+	cmds := s.reply(apiResponse("second\n"))
+	ev, err := h.Send("api version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Body != "second\n" {
+		t.Errorf("Send got reply %q", ev.Body)
+	}
+	command(t, cmds)
+}
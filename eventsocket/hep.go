@@ -0,0 +1,138 @@
+// Copyright 2013 Alexandre Fiori
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package eventsocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+var errNoCallID = errors.New("Event has no SIP Call-ID")
+
+// HEP chunk types, see the HEPv3 specification.
+const (
+	hepFamily        = 0x0001
+	hepProtocol      = 0x0002
+	hepSrcIPv4       = 0x0003
+	hepDstIPv4       = 0x0004
+	hepSrcIPv6       = 0x0005
+	hepDstIPv6       = 0x0006
+	hepSrcPort       = 0x0007
+	hepDstPort       = 0x0008
+	hepTimestamp     = 0x0009
+	hepTimestampUsec = 0x000a
+	hepProtoType     = 0x000b
+	hepCaptureID     = 0x000c
+	hepAuthKey       = 0x000e
+	hepPayload       = 0x000f
+	hepCorrelationID = 0x0011
+)
+
+// HEPOptions are the options of Event.ToHEP.
+type HEPOptions struct {
+	CaptureID uint32 // ID of the capture agent
+	AuthKey   string // Password of the collector, if any
+	ProtoType uint8  // Type of the payload, 100 (log) if zero
+}
+
+// ToHEP encodes the event as a HEPv3 packet for a Homer collector, with the
+// SIP Call-ID of the channel, from the sip_call_id variable, as correlation
+// ID so the event shows up along with the SIP capture of the call. The
+// payload is the event in JSON.
+//
+// The source address is the FreeSWITCH instance and the destination the
+// caller, when known. It returns an error if the event has no Call-ID.
+//
+// See https://github.com/sipcapture/HEP for details.
+func (r *Event) ToHEP(opts HEPOptions) ([]byte, error) {
+	callID := r.Variable("sip_call_id")
+	if callID == "" {
+		return nil, errNoCallID
+	}
+	payload, err := r.marshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	ts, err := r.getTime("Event-Date-Timestamp")
+	if err != nil {
+		return nil, err
+	}
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	protoType := opts.ProtoType
+	if protoType == 0 {
+		protoType = 100
+	}
+
+	b := new(bytes.Buffer)
+	b.WriteString("HEP3")
+	b.Write([]byte{0, 0}) // Total length, set below.
+	src, dst := r.SourceIP(), r.CallerIP()
+	family, srcType, dstType := uint8(2), uint16(hepSrcIPv4), uint16(hepDstIPv4)
+	if (src != nil && src.To4() == nil) || (src == nil && dst != nil && dst.To4() == nil) {
+		family, srcType, dstType = 10, hepSrcIPv6, hepDstIPv6
+	}
+	writeHEPChunk(b, hepFamily, []byte{family})
+	writeHEPChunk(b, hepProtocol, []byte{17}) // UDP
+	writeHEPChunk(b, srcType, hepIP(src, family))
+	writeHEPChunk(b, dstType, hepIP(dst, family))
+	writeHEPChunk(b, hepSrcPort, hepUint16(0))
+	writeHEPChunk(b, hepDstPort, hepUint16(0))
+	writeHEPChunk(b, hepTimestamp, hepUint32(uint32(ts.Unix())))
+	writeHEPChunk(b, hepTimestampUsec, hepUint32(uint32(ts.Nanosecond()/1000)))
+	writeHEPChunk(b, hepProtoType, []byte{protoType})
+	writeHEPChunk(b, hepCaptureID, hepUint32(opts.CaptureID))
+	if opts.AuthKey != "" {
+		writeHEPChunk(b, hepAuthKey, []byte(opts.AuthKey))
+	}
+	writeHEPChunk(b, hepCorrelationID, []byte(callID))
+	writeHEPChunk(b, hepPayload, payload)
+	packet := b.Bytes()
+	if len(packet) > 0xffff {
+		return nil, errors.New("Event too large for a HEP packet")
+	}
+	binary.BigEndian.PutUint16(packet[4:], uint16(len(packet)))
+	return packet, nil
+}
+
+// writeHEPChunk appends a generic HEP chunk of type t to b.
+func writeHEPChunk(b *bytes.Buffer, t uint16, data []byte) {
+	var hdr [6]byte // Vendor 0, type and length including the header.
+	binary.BigEndian.PutUint16(hdr[2:], t)
+	binary.BigEndian.PutUint16(hdr[4:], uint16(len(hdr)+len(data)))
+	b.Write(hdr[:])
+	b.Write(data)
+}
+
+// hepIP returns ip in the format of the address family, or the unspecified
+// address if it's nil or doesn't fit.
+func hepIP(ip net.IP, family uint8) []byte {
+	if family == 2 {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+		return net.IPv4zero.To4()
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return ip16
+	}
+	return net.IPv6unspecified
+}
+
+func hepUint16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func hepUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
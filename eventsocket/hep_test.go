@@ -0,0 +1,54 @@
+// Copyright 2013 Alexandre Fiori
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package eventsocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestToHEP(t *testing.T) {
+	ev := &Event{Header: EventHeader{
+		"Event-Name":           "CHANNEL_ANSWER",
+		"Event-Date-Timestamp": "1357139045000000",
+		"Freeswitch-Ipv4":      "10.0.0.5",
+		"Caller-Network-Addr":  "1.2.3.4",
+		"Variable_sip_call_id": "call-1@example.com",
+	}}
+	b, err := ev.ToHEP(HEPOptions{CaptureID: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte("HEP3")) {
+		t.Fatalf("Packet starts with %q", b[:4])
+	}
+	if n := int(binary.BigEndian.Uint16(b[4:])); n != len(b) {
+		t.Errorf("Packet length is %d, want %d", n, len(b))
+	}
+	chunks := make(map[uint16][]byte)
+	for p := b[6:]; len(p) >= 6; {
+		n := int(binary.BigEndian.Uint16(p[4:]))
+		if n < 6 || n > len(p) {
+			t.Fatalf("Invalid chunk length %d", n)
+		}
+		chunks[binary.BigEndian.Uint16(p[2:])] = p[6:n]
+		p = p[n:]
+	}
+	if id := string(chunks[hepCorrelationID]); id != "call-1@example.com" {
+		t.Errorf("Correlation ID is %q", id)
+	}
+	if !bytes.Equal(chunks[hepSrcIPv4], []byte{10, 0, 0, 5}) ||
+		!bytes.Equal(chunks[hepDstIPv4], []byte{1, 2, 3, 4}) {
+		t.Errorf("Addresses are %v and %v", chunks[hepSrcIPv4], chunks[hepDstIPv4])
+	}
+	if !bytes.Contains(chunks[hepPayload], []byte(`"CHANNEL_ANSWER"`)) {
+		t.Errorf("Payload is %s", chunks[hepPayload])
+	}
+
+	if _, err = (&Event{Header: EventHeader{}}).ToHEP(HEPOptions{}); err != errNoCallID {
+		t.Errorf("ToHEP without Call-ID returned %v", err)
+	}
+}
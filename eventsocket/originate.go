@@ -0,0 +1,267 @@
+// Copyright 2013 Alexandre Fiori
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package eventsocket
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Originate calls dest and connects the call to app once answered. The
+// channel variables in vars, if any, are set on the new channel. It returns
+// the UUID of the new channel and the reply.
+//
+// Example:
+//
+//	Originate("sofia/gateway/gw1/5551234", "&park()", nil)
+//	Originate("user/1000", "9196 XML default", map[string]string{
+//		"origination_caller_id_number": "5550000",
+//	})
+//
+// See https://freeswitch.org/confluence/display/FREESWITCH/mod_commands#originate
+// for details.
+func (h *Connection) Originate(dest, app string, vars map[string]string) (string, *Event, error) {
+	cmd, err := originateCommand(dest, app, vars)
+	if err != nil {
+		return "", nil, err
+	}
+	ev, err := h.sendAPI(cmd)
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.TrimSpace(strings.TrimPrefix(ev.Body, "+OK")), ev, nil
+}
+
+// originateCommand returns the originate command of Originate.
+func originateCommand(dest, app string, vars map[string]string) (string, error) {
+	if err := checkDialString(dest); err != nil {
+		return "", err
+	}
+	if app == "" {
+		return "", errInvalidArg
+	}
+	if err := checkArgs(app); err != nil {
+		return "", err
+	}
+	block, err := EncodeChannelVars(vars)
+	if err != nil {
+		return "", err
+	}
+	return "originate " + block + dest + " " + app, nil
+}
+
+// OriginateUUID is like Originate, but assigns uuid to the new channel with
+// origination_uuid, so the call can be tracked before Originate returns.
+func (h *Connection) OriginateUUID(uuid, dest, app string, vars map[string]string) (string, *Event, error) {
+	if err := checkWords(uuid); err != nil {
+		return "", nil, err
+	}
+	v := make(map[string]string, len(vars)+1)
+	for k, val := range vars {
+		v[k] = val
+	}
+	v["origination_uuid"] = uuid
+	_, ev, err := h.Originate(dest, app, v)
+	if err != nil {
+		return "", nil, err
+	}
+	return uuid, ev, nil
+}
+
+// OriginateToConference is like Originate, but joins the call to the
+// conference room once answered. room may include a profile, as in
+// "3000@default".
+func (h *Connection) OriginateToConference(dest, room string, vars map[string]string) (string, *Event, error) {
+	if err := checkWords(room); err != nil {
+		return "", nil, err
+	}
+	if strings.ContainsAny(room, "()") {
+		return "", nil, errInvalidArg
+	}
+	return h.Originate(dest, "&conference("+room+")", vars)
+}
+
+// OriginateCancelable is like Originate, but runs originate in the
+// background with bgapi, so the call attempt can be aborted: when ctx is
+// done before the call is answered, the new channel is killed with
+// uuid_kill and ctx.Err() is returned.
+//
+// If the channel doesn't exist yet when ctx is done, it waits for the
+// originate to complete, up to a minute, and kills the call if it was
+// answered in the meantime. Errors killing an existing call are returned
+// instead of ctx.Err().
+//
+// It requires a subscription to BACKGROUND_JOB events, like
+// BgAPIWithJobUUID.
+func (h *Connection) OriginateCancelable(ctx context.Context, dest, app string, vars map[string]string) (string, *Event, error) {
+	uuid, err := newUUID()
+	if err != nil {
+		return "", nil, err
+	}
+	jobUUID, err := newUUID()
+	if err != nil {
+		return "", nil, err
+	}
+	v := make(map[string]string, len(vars)+1)
+	for k, val := range vars {
+		v[k] = val
+	}
+	v["origination_uuid"] = uuid
+	cmd, err := originateCommand(dest, app, v)
+	if err != nil {
+		return "", nil, err
+	}
+	job, err := h.BgAPIWithJobUUID(cmd, jobUUID)
+	if err != nil {
+		return "", nil, err
+	}
+	select {
+	case ev, ok := <-job:
+		if !ok {
+			return "", nil, errClosed
+		}
+		if body := strings.TrimSpace(ev.Body); !strings.HasPrefix(body, "+OK") {
+			return "", ev, newCommandError(body)
+		}
+		return uuid, ev, nil
+	case <-ctx.Done():
+	}
+	_, err = h.sendAPI("uuid_kill", uuid, "ORIGINATOR_CANCEL")
+	if _, ok := err.(*CommandError); !ok {
+		h.forgetJob(jobUUID)
+		if err == nil {
+			err = ctx.Err()
+		}
+		return "", nil, err
+	}
+	// The channel doesn't exist, but the originate may still succeed.
+	select {
+	case ev, ok := <-job:
+		if !ok {
+			return "", nil, errClosed
+		}
+		if strings.HasPrefix(strings.TrimSpace(ev.Body), "+OK") {
+			if _, err = h.sendAPI("uuid_kill", uuid, "ORIGINATOR_CANCEL"); err != nil {
+				return "", ev, err
+			}
+		}
+		return "", ev, ctx.Err()
+	case <-time.After(timeoutPeriod):
+		h.forgetJob(jobUUID)
+		return "", nil, ctx.Err()
+	}
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// DialString is a dial string for originate and bridge, built from an
+// endpoint and optional channel variables.
+//
+// Example:
+//
+//	dest, err := eventsocket.Gateway("gw1", "5551234").
+//		WithVars(map[string]string{"ignore_early_media": "true"}).
+//		Build()
+//	// dest is {ignore_early_media=true}sofia/gateway/gw1/5551234
+type DialString struct {
+	endpoint string
+	vars     map[string]string
+}
+
+// Sofia returns the dial string of target through the sofia profile, e.g.
+// sofia/internal/1000@example.com.
+func Sofia(profile, target string) *DialString {
+	return &DialString{endpoint: "sofia/" + profile + "/" + target}
+}
+
+// Gateway returns the dial string of number through the sofia gateway, e.g.
+// sofia/gateway/gw1/5551234.
+func Gateway(gateway, number string) *DialString {
+	return &DialString{endpoint: "sofia/gateway/" + gateway + "/" + number}
+}
+
+// User returns the dial string of the directory user ext, e.g. user/1000 or
+// user/1000@example.com.
+func User(ext string) *DialString {
+	return &DialString{endpoint: "user/" + ext}
+}
+
+// WithVars adds the channel variables in vars to the dial string, and
+// returns it.
+func (d *DialString) WithVars(vars map[string]string) *DialString {
+	if d.vars == nil {
+		d.vars = make(map[string]string, len(vars))
+	}
+	for k, v := range vars {
+		d.vars[k] = v
+	}
+	return d
+}
+
+// Build returns the dial string, or an error if it's invalid.
+func (d *DialString) Build() (string, error) {
+	block, err := EncodeChannelVars(d.vars)
+	if err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(d.endpoint, "{}[] \t") {
+		return "", fmt.Errorf("Invalid endpoint %q", d.endpoint)
+	}
+	dest := block + d.endpoint
+	if err := checkDialString(dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// String returns the dial string, or "" if it's invalid.
+func (d *DialString) String() string {
+	dest, _ := d.Build()
+	return dest
+}
+
+// checkDialString rejects empty dial strings, and those with line breaks,
+// unbalanced braces or brackets, or whitespace outside of variable blocks.
+func checkDialString(dest string) error {
+	if dest == "" {
+		return errInvalidArg
+	}
+	if err := checkArgs(dest); err != nil {
+		return err
+	}
+	var stack []rune
+	for _, c := range dest {
+		switch c {
+		case '{', '[', '<':
+			stack = append(stack, c)
+		case '}', ']', '>':
+			open := rune("{[<"[strings.IndexRune("}]>", c)])
+			if len(stack) == 0 || stack[len(stack)-1] != open {
+				return fmt.Errorf("Unbalanced %q in dial string %q", c, dest)
+			}
+			stack = stack[:len(stack)-1]
+		case ' ', '\t':
+			if len(stack) == 0 {
+				return errInvalidArg
+			}
+		}
+	}
+	if len(stack) > 0 {
+		return fmt.Errorf("Unbalanced %q in dial string %q", stack[len(stack)-1], dest)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2013 Alexandre Fiori
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package eventsocket
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+func TestOriginateUUID(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("+OK abc\n"))
+	uuid, _, err := h.OriginateUUID("abc", "user/1000", "&park()", map[string]string{
+		"origination_caller_id_number": "5550000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uuid != "abc" {
+		t.Errorf("OriginateUUID returned %q", uuid)
+	}
+	want := "api originate {origination_caller_id_number=5550000,origination_uuid=abc}user/1000 &park()"
+	if cmd := command(t, cmds); cmd != want {
+		t.Errorf("Sent %q, want %q", cmd, want)
+	}
+}
+
+func TestOriginateToConference(t *testing.T) {
+	h, s := newTestConn(t)
+	cmds := s.reply(apiResponse("+OK abc\n"))
+	uuid, _, err := h.OriginateToConference("user/1000", "3000@default", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uuid != "abc" {
+		t.Errorf("OriginateToConference returned %q", uuid)
+	}
+	if cmd := command(t, cmds); cmd != "api originate user/1000 &conference(3000@default)" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if _, _, err = h.OriginateToConference("user/1000", "3000)", nil); err != errInvalidArg {
+		t.Errorf("OriginateToConference with a parenthesis returned %v", err)
+	}
+}
+
+func TestOriginateCancelable(t *testing.T) {
+	re := regexp.MustCompile(`origination_uuid=([^,}]+).*\nJob-UUID: (.+)`)
+	for _, answered := range []bool{false, true} {
+		h, s := newTestConn(t)
+		cmds := make(chan string, 3)
+		go func() {
+			cmd, err := s.readCommand()
+			if err != nil {
+				return
+			}
+			cmds <- cmd
+			m := re.FindStringSubmatch(cmd)
+			if m == nil {
+				return
+			}
+			s.conn.Write([]byte(commandReply("+OK Job-UUID: " + m[2])))
+			if cmd, err = s.readCommand(); err != nil {
+				return
+			}
+			cmds <- cmd
+			if !answered {
+				s.conn.Write([]byte(apiResponse("+OK\n")))
+				return
+			}
+			// The kill beats the channel, which is answered afterwards.
+			s.conn.Write([]byte(apiResponse("-ERR No such channel!\n")))
+			body := "+OK " + m[1] + "\n"
+			s.conn.Write([]byte(plainEvent("Event-Name: BACKGROUND_JOB\nJob-UUID: " + m[2] +
+				"\nContent-Length: " + strconv.Itoa(len(body)) + "\n\n" + body)))
+			if cmd, err = s.readCommand(); err != nil {
+				return
+			}
+			cmds <- cmd
+			s.conn.Write([]byte(apiResponse("+OK\n")))
+		}()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, _, err := h.OriginateCancelable(ctx, "user/1000", "&park()", nil); err != context.Canceled {
+			t.Errorf("OriginateCancelable returned %v", err)
+		}
+		m := re.FindStringSubmatch(command(t, cmds))
+		if m == nil {
+			t.Fatal("No origination_uuid in the bgapi command")
+		}
+		kills := 1
+		if answered {
+			kills = 2
+		}
+		for i := 0; i < kills; i++ {
+			if cmd := command(t, cmds); cmd != "api uuid_kill "+m[1]+" ORIGINATOR_CANCEL" {
+				t.Errorf("Sent %q", cmd)
+			}
+		}
+		h.mu.Lock()
+		n := len(h.jobs)
+		h.mu.Unlock()
+		if n != 0 {
+			t.Errorf("%d jobs left after cancelling", n)
+		}
+	}
+}
+
+func TestDialString(t *testing.T) {
+	dest, err := Gateway("gw1", "5551234").
+		WithVars(map[string]string{"ignore_early_media": "true", "name": "John Doe"}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "{ignore_early_media=true,name='John Doe'}sofia/gateway/gw1/5551234"; dest != want {
+		t.Errorf("Build returned %q, want %q", dest, want)
+	}
+	if s := User("1000@example.com").String(); s != "user/1000@example.com" {
+		t.Errorf("User dial string is %q", s)
+	}
+	if _, err = Gateway("gw 1", "5551234").Build(); err == nil {
+		t.Error("Build of a gateway with a space returned no error")
+	}
+}
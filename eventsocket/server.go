@@ -0,0 +1,328 @@
+// Copyright 2013 Alexandre Fiori
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package eventsocket
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	errAlreadyAdopted = errors.New("UUID already adopted")
+	errServerClosed   = errors.New("Server closed")
+)
+
+// ConnectHandleFunc is the function called on new incoming connections,
+// after the connect command, with the channel data it returned.
+type ConnectHandleFunc func(*Connection, *Event)
+
+// ListenAndServeConnect is like ListenAndServe, but sends the connect
+// command on new connections and calls ConnectHandleFunc with its reply, so
+// the handler starts with the channel data at hand.
+//
+// Example:
+//
+//	func handler(c *eventsocket.Connection, data *eventsocket.Event) {
+//		fmt.Println("new call from", data.Get("Caller-Caller-Id-Number"))
+//		...
+//	}
+func ListenAndServeConnect(addr string, fn ConnectHandleFunc) error {
+	srv := &Server{Addr: addr, ConnectHandler: fn}
+	return srv.ListenAndServe()
+}
+
+// Server accepts outbound event socket connections from FreeSWITCH and
+// calls a handler in a new goroutine for each of them.
+//
+// If ConnectHandler is set, the server sends the connect command on new
+// connections and calls ConnectHandler with the channel data. Connections
+// failing to connect are closed. Otherwise Handler is called right away.
+type Server struct {
+	Addr           string            // TCP address to listen on, e.g. ":9090"
+	Handler        HandleFunc        // Called for each new connection
+	ConnectHandler ConnectHandleFunc // Called after connect, if set
+
+	// PanicHandler, if set, is called with the value of panics in the
+	// handlers, after closing their connection. Without it a panicking
+	// handler crashes the program.
+	PanicHandler func(*Connection, interface{})
+
+	mu       sync.Mutex
+	adopted  map[string]*adoption
+	ln       net.Listener
+	conns    map[*Connection]struct{}
+	shutdown bool
+}
+
+// adoption is the destination of the events of an adopted UUID. ev is the
+// queue of the adopter.
+type adoption struct {
+	dropped int64 // Events dropped on a full queue, first for alignment
+	ev      chan *Event
+	done    chan struct{}
+}
+
+// newAdoption returns an adoption with a queue of eventsQueue events.
+func newAdoption() *adoption {
+	return &adoption{
+		ev:   make(chan *Event, eventsQueue),
+		done: make(chan struct{}),
+	}
+}
+
+// ListenAndServe listens on srv.Addr and serves incoming connections.
+func (srv *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	srv.mu.Lock()
+	if srv.shutdown {
+		srv.mu.Unlock()
+		ln.Close()
+		return errServerClosed
+	}
+	srv.ln = ln
+	srv.mu.Unlock()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			if srv.shutdown {
+				return errServerClosed
+			}
+			return err
+		}
+		h := newConnection(c)
+		h.srv = srv
+		if !srv.track(h) {
+			h.Close()
+			continue
+		}
+		go func() {
+			h.readLoop()
+			srv.forget(h)
+		}()
+		go srv.serve(h)
+	}
+}
+
+// track adds h to the active connections, unless the server is shutting
+// down.
+func (srv *Server) track(h *Connection) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.shutdown {
+		return false
+	}
+	if srv.conns == nil {
+		srv.conns = make(map[*Connection]struct{})
+	}
+	srv.conns[h] = struct{}{}
+	return true
+}
+
+// forget removes h from the active connections.
+func (srv *Server) forget(h *Connection) {
+	srv.mu.Lock()
+	delete(srv.conns, h)
+	srv.mu.Unlock()
+}
+
+// Shutdown stops accepting connections and closes the active ones.
+// ListenAndServe then returns an error.
+//
+// If drain is true, each connection is first sent the resume command, so
+// its call goes on with the dialplan instead of being hung up when the
+// connection closes. This lets calls in progress survive a restart of the
+// server.
+func (srv *Server) Shutdown(drain bool) error {
+	srv.mu.Lock()
+	srv.shutdown = true
+	ln := srv.ln
+	conns := make([]*Connection, 0, len(srv.conns))
+	for h := range srv.conns {
+		conns = append(conns, h)
+	}
+	srv.mu.Unlock()
+	var err error
+	if ln != nil {
+		err = ln.Close()
+	}
+	var wg sync.WaitGroup
+	for _, h := range conns {
+		wg.Add(1)
+		go func(h *Connection) {
+			defer wg.Done()
+			if drain {
+				// Closing anyway, there's nothing to do on errors.
+				h.Resume()
+			}
+			h.Close()
+		}(h)
+	}
+	wg.Wait()
+	return err
+}
+
+// serve calls the handler of the server for the new connection h.
+func (srv *Server) serve(h *Connection) {
+	if srv.PanicHandler != nil {
+		defer func() {
+			if v := recover(); v != nil {
+				h.Close()
+				srv.PanicHandler(h, v)
+			}
+		}()
+	}
+	if srv.ConnectHandler == nil {
+		srv.Handler(h)
+		return
+	}
+	ev, err := h.Send("connect")
+	if err != nil {
+		h.Close()
+		return
+	}
+	srv.ConnectHandler(h, ev)
+}
+
+// Adopt transfers the ownership of the events of the channel uuid to the
+// caller. Events for uuid received by any connection of the server after
+// Adopt returns are delivered to the returned channel instead of the
+// connection's ReadEvent.
+//
+// It's meant for handing a call over, typically parked, from the handler of
+// its outbound connection to another goroutine. The channel is never closed;
+// call Release when done with it.
+//
+// The channel is the adopter's own queue, buffering up to 1024 events.
+// Events are never held up waiting for the adopter, so a slow adopter can't
+// stall the connection: when the queue is full, new events for uuid are
+// dropped and counted by DroppedEvents. Adopters must keep up with their
+// events to get all of them.
+func (srv *Server) Adopt(uuid string) (<-chan *Event, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if _, exists := srv.adopted[uuid]; exists {
+		return nil, errAlreadyAdopted
+	}
+	if srv.adopted == nil {
+		srv.adopted = make(map[string]*adoption)
+	}
+	a := newAdoption()
+	srv.adopted[uuid] = a
+	return a.ev, nil
+}
+
+// DroppedEvents returns the number of events of the adopted uuid dropped so
+// far because its channel was full, see Adopt.
+func (srv *Server) DroppedEvents(uuid string) int64 {
+	srv.mu.Lock()
+	a := srv.adopted[uuid]
+	srv.mu.Unlock()
+	if a == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&a.dropped)
+}
+
+// Release stops delivering the events of uuid to its adopter. Subsequent
+// events go back to the connection's ReadEvent.
+func (srv *Server) Release(uuid string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if a, exists := srv.adopted[uuid]; exists {
+		close(a.done)
+		delete(srv.adopted, uuid)
+	}
+}
+
+// deliver sends ev to the adopter of its UUID, if any, and returns true if
+// the event was taken. It never blocks, see Adopt.
+func (srv *Server) deliver(ev *Event) bool {
+	uuid := ev.UniqueID()
+	if uuid == "" {
+		return false
+	}
+	srv.mu.Lock()
+	a := srv.adopted[uuid]
+	srv.mu.Unlock()
+	if a == nil {
+		return false
+	}
+	return a.send(ev)
+}
+
+// send queues ev for the adopter without blocking, and returns false if the
+// adoption was released. The event is dropped if the queue is full.
+func (a *adoption) send(ev *Event) bool {
+	select {
+	case <-a.done:
+		return false
+	default:
+	}
+	select {
+	case a.ev <- ev:
+	default:
+		atomic.AddInt64(&a.dropped, 1)
+	}
+	return true
+}
+
+// Dispatcher routes outbound connections to handlers registered with Handle,
+// by a key computed from their channel data.
+//
+// Example:
+//
+//	d := &eventsocket.Dispatcher{
+//		Key: func(data *eventsocket.Event) string {
+//			return data.Get("Caller-Destination-Number")
+//		},
+//	}
+//	d.Handle("1000", sales)
+//	d.Handle("2000", support)
+//	d.ListenAndServe(":9090")
+type Dispatcher struct {
+	Key     func(data *Event) string // Computes the key of a connection
+	Default ConnectHandleFunc        // Called if no handler matches, if set
+
+	mu       sync.Mutex
+	handlers map[string]ConnectHandleFunc
+}
+
+// Handle registers fn as the handler of the connections whose key is key.
+func (d *Dispatcher) Handle(key string, fn ConnectHandleFunc) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.handlers == nil {
+		d.handlers = make(map[string]ConnectHandleFunc)
+	}
+	d.handlers[key] = fn
+}
+
+// ServeConnect calls the handler matching the key of the connection, or the
+// Default handler. Connections without a handler are closed.
+func (d *Dispatcher) ServeConnect(c *Connection, data *Event) {
+	d.mu.Lock()
+	fn, ok := d.handlers[d.Key(data)]
+	d.mu.Unlock()
+	if !ok {
+		fn = d.Default
+	}
+	if fn == nil {
+		c.Close()
+		return
+	}
+	fn(c, data)
+}
+
+// ListenAndServe listens on addr and dispatches incoming connections.
+func (d *Dispatcher) ListenAndServe(addr string) error {
+	return ListenAndServeConnect(addr, d.ServeConnect)
+}
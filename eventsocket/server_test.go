@@ -0,0 +1,208 @@
+// Copyright 2013 Alexandre Fiori
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package eventsocket
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newServerTestConn is like newTestConn, for a connection accepted by srv.
+func newServerTestConn(t *testing.T, srv *Server) (*Connection, *fakeServer) {
+	a, b := net.Pipe()
+	h := newConnection(a)
+	h.srv = srv
+	go h.readLoop()
+	t.Cleanup(func() {
+		h.Close()
+		b.Close()
+	})
+	return h, &fakeServer{t: t, conn: b, r: bufio.NewReader(b)}
+}
+
+func TestAdopt(t *testing.T) {
+	srv := &Server{}
+	h, s := newServerTestConn(t, srv)
+	evc, err := srv.Adopt("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = srv.Adopt("abc"); err != errAlreadyAdopted {
+		t.Errorf("Adopting twice returned %v", err)
+	}
+	s.send(
+		plainEvent("Event-Name: CHANNEL_PARK\nUnique-ID: abc\n\n"),
+		plainEvent("Event-Name: CHANNEL_PARK\nUnique-ID: other\n\n"),
+	)
+	if ev := <-evc; ev.UniqueID() != "abc" {
+		t.Errorf("Adopter got %v", ev)
+	}
+	ev, err := h.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.UniqueID() != "other" {
+		t.Errorf("ReadEvent got %v", ev)
+	}
+	srv.Release("abc")
+	s.send(plainEvent("Event-Name: CHANNEL_HANGUP\nUnique-ID: abc\n\n"))
+	if ev, err = h.ReadEvent(); err != nil || ev.UniqueID() != "abc" {
+		t.Errorf("ReadEvent after Release got %v, %v", ev, err)
+	}
+}
+
+func TestAdoptSlowAdopter(t *testing.T) {
+	srv := &Server{}
+	h, s := newServerTestConn(t, srv)
+	evc, err := srv.Adopt("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nobody reads evc, nor ReadEvent until the reply.
+	const overflow = 5
+	go func() {
+		if _, err := s.readCommand(); err != nil {
+			return
+		}
+		for i := 0; i < eventsQueue+overflow; i++ {
+			s.conn.Write([]byte(plainEvent("Event-Name: HEARTBEAT\nUnique-ID: abc\n\n")))
+		}
+		s.conn.Write([]byte(plainEvent("Event-Name: HEARTBEAT\n\n")))
+		s.conn.Write([]byte(apiResponse("+OK\n")))
+	}()
+	if _, err = h.Send("api status"); err != nil {
+		t.Fatal(err)
+	}
+	// The overflow is dropped, not handed to the connection's reader.
+	if ev, err := h.ReadEvent(); err != nil || ev.UniqueID() != "" {
+		t.Errorf("ReadEvent got %v, %v", ev, err)
+	}
+	if n := len(evc); n != eventsQueue {
+		t.Errorf("Adopter got %d events, want %d", n, eventsQueue)
+	}
+	if n := srv.DroppedEvents("abc"); n != overflow {
+		t.Errorf("DroppedEvents returned %d, want %d", n, overflow)
+	}
+}
+
+func TestConnectHandler(t *testing.T) {
+	data := make(chan *Event, 1)
+	srv := &Server{ConnectHandler: func(c *Connection, ev *Event) {
+		data <- ev
+	}}
+	h, s := newServerTestConn(t, srv)
+	cmds := s.reply("Content-Type: command/reply\nReply-Text: +OK\n" +
+		"Caller-Caller-ID-Number: 1000\nUnique-ID: abc\n\n")
+	go srv.serve(h)
+	if cmd := command(t, cmds); cmd != "connect" {
+		t.Errorf("Sent %q", cmd)
+	}
+	select {
+	case ev := <-data:
+		if ev.Get("Caller-Caller-Id-Number") != "1000" || ev.UniqueID() != "abc" {
+			t.Errorf("ConnectHandler got %v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ConnectHandler not called")
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	var got []string
+	d := &Dispatcher{Key: func(data *Event) string {
+		return data.Get("Caller-Destination-Number")
+	}}
+	d.Handle("1000", func(c *Connection, data *Event) { got = append(got, "sales") })
+	d.Handle("2000", func(c *Connection, data *Event) { got = append(got, "support") })
+	h, _ := newTestConn(t)
+	for _, dest := range []string{"2000", "1000"} {
+		d.ServeConnect(h, &Event{Header: EventHeader{"Caller-Destination-Number": dest}})
+	}
+	if len(got) != 2 || got[0] != "support" || got[1] != "sales" {
+		t.Errorf("Connections routed to %v", got)
+	}
+
+	// Unmatched connections are closed, unless there's a default.
+	d.ServeConnect(h, &Event{Header: EventHeader{"Caller-Destination-Number": "3000"}})
+	if !h.isClosing() {
+		t.Error("Unmatched connection not closed")
+	}
+	d.Default = func(c *Connection, data *Event) { got = append(got, "default") }
+	d.ServeConnect(h, &Event{Header: EventHeader{"Caller-Destination-Number": "3000"}})
+	if got[len(got)-1] != "default" {
+		t.Errorf("Connections routed to %v", got)
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	connected := make(chan struct{})
+	srv := &Server{Addr: "127.0.0.1:0", Handler: func(c *Connection) {
+		close(connected)
+	}}
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServe() }()
+	var addr net.Addr
+	for addr == nil {
+		srv.mu.Lock()
+		if srv.ln != nil {
+			addr = srv.ln.Addr()
+		}
+		srv.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	<-connected
+	go srv.Shutdown(true)
+	s := &fakeServer{t: t, conn: c, r: bufio.NewReader(c)}
+	cmd, err := s.readCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd != "resume" {
+		t.Errorf("Sent %q before closing", cmd)
+	}
+	c.Write([]byte(commandReply("+OK")))
+	if _, err = s.r.ReadByte(); err != io.EOF {
+		t.Errorf("Read %v after resume, want the connection closed", err)
+	}
+	select {
+	case err = <-done:
+		if err != errServerClosed {
+			t.Errorf("ListenAndServe returned %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("ListenAndServe still running after Shutdown")
+	}
+}
+
+func TestPanicHandler(t *testing.T) {
+	got := make(chan interface{}, 1)
+	srv := &Server{
+		Handler: func(c *Connection) { panic("boom") },
+		PanicHandler: func(c *Connection, v interface{}) {
+			if !c.isClosing() {
+				t.Error("Connection not closed before PanicHandler")
+			}
+			got <- v
+		},
+	}
+	h, _ := newServerTestConn(t, srv)
+	go srv.serve(h)
+	select {
+	case v := <-got:
+		if v != "boom" {
+			t.Errorf("PanicHandler got %v", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("PanicHandler not called")
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2013 Alexandre Fiori
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package eventsocket
+
+import "sync"
+
+// CallState is the lifecycle state of a call tracked by CallTracker.
+type CallState int
+
+// Call states, in lifecycle order.
+const (
+	CallCreated CallState = iota + 1
+	CallRinging
+	CallAnswered
+	CallBridged
+	CallHungup
+)
+
+var callStateNames = map[CallState]string{
+	CallCreated:  "created",
+	CallRinging:  "ringing",
+	CallAnswered: "answered",
+	CallBridged:  "bridged",
+	CallHungup:   "hungup",
+}
+
+// String returns the name of the state, e.g. answered.
+func (s CallState) String() string {
+	if name, ok := callStateNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// CallTracker tracks the state of calls from their channel events. It needs
+// a subscription to CHANNEL_CREATE, CHANNEL_PROGRESS, CHANNEL_PROGRESS_MEDIA,
+// CHANNEL_ANSWER, CHANNEL_BRIDGE, CHANNEL_UNBRIDGE, CHANNEL_HANGUP and
+// CHANNEL_DESTROY events.
+//
+// Calls move forward only, except for unbridged calls going back to
+// answered. They're forgotten on CHANNEL_DESTROY.
+//
+// Example:
+//
+//	t := &eventsocket.CallTracker{
+//		OnChange: func(uuid string, from, to eventsocket.CallState, ev *eventsocket.Event) {
+//			fmt.Println(uuid, from, "->", to)
+//		},
+//	}
+//	c.Send("events json CHANNEL_CREATE CHANNEL_ANSWER CHANNEL_HANGUP CHANNEL_DESTROY")
+//	err := t.Run(c)
+type CallTracker struct {
+	// OnChange is called, if set, when a call changes state. from is zero
+	// for calls seen for the first time.
+	OnChange func(uuid string, from, to CallState, ev *Event)
+
+	mu    sync.Mutex
+	calls map[string]CallState
+}
+
+// Run feeds the tracker with the events read from c, until ReadEvent fails.
+func (t *CallTracker) Run(c *Connection) error {
+	for {
+		ev, err := c.ReadEvent()
+		if err != nil {
+			return err
+		}
+		t.Feed(ev)
+	}
+}
+
+// Feed updates the state of the call of ev. Other events are ignored.
+func (t *CallTracker) Feed(ev *Event) {
+	uuid := ev.UniqueID()
+	if uuid == "" {
+		return
+	}
+	var to CallState
+	switch ev.Name() {
+	case "CHANNEL_CREATE":
+		to = CallCreated
+	case "CHANNEL_PROGRESS", "CHANNEL_PROGRESS_MEDIA":
+		to = CallRinging
+	case "CHANNEL_ANSWER", "CHANNEL_UNBRIDGE":
+		to = CallAnswered
+	case "CHANNEL_BRIDGE":
+		to = CallBridged
+	case "CHANNEL_HANGUP", "CHANNEL_HANGUP_COMPLETE":
+		to = CallHungup
+	case "CHANNEL_DESTROY":
+		t.mu.Lock()
+		delete(t.calls, uuid)
+		t.mu.Unlock()
+		return
+	default:
+		return
+	}
+	t.mu.Lock()
+	from := t.calls[uuid]
+	unbridge := from == CallBridged && ev.Name() == "CHANNEL_UNBRIDGE"
+	if to <= from && !unbridge {
+		t.mu.Unlock()
+		return
+	}
+	if t.calls == nil {
+		t.calls = make(map[string]CallState)
+	}
+	t.calls[uuid] = to
+	fn := t.OnChange
+	t.mu.Unlock()
+	if fn != nil {
+		fn(uuid, from, to, ev)
+	}
+}
+
+// State returns the state of the call uuid, and false if it's not tracked.
+func (t *CallTracker) State(uuid string) (CallState, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.calls[uuid]
+	return s, ok
+}
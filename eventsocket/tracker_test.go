@@ -0,0 +1,49 @@
+// Copyright 2013 Alexandre Fiori
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package eventsocket
+
+import "testing"
+
+func TestCallTracker(t *testing.T) {
+	var changes []string
+	tr := &CallTracker{OnChange: func(uuid string, from, to CallState, ev *Event) {
+		changes = append(changes, from.String()+"->"+to.String())
+	}}
+	for _, name := range []string{
+		"CHANNEL_CREATE",
+		"CHANNEL_PROGRESS",
+		"CHANNEL_PROGRESS_MEDIA", // Already ringing
+		"CHANNEL_ANSWER",
+		"CHANNEL_BRIDGE",
+		"CHANNEL_UNBRIDGE",
+		"CHANNEL_PROGRESS", // Calls don't go back
+		"CHANNEL_HANGUP",
+	} {
+		tr.Feed(&Event{Header: EventHeader{"Event-Name": name, "Unique-Id": "abc"}})
+	}
+	want := []string{
+		"unknown->created",
+		"created->ringing",
+		"ringing->answered",
+		"answered->bridged",
+		"bridged->answered",
+		"answered->hungup",
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("Changes are %v, want %v", changes, want)
+	}
+	for n := range want {
+		if changes[n] != want[n] {
+			t.Errorf("Change %d is %s, want %s", n, changes[n], want[n])
+		}
+	}
+	if s, ok := tr.State("abc"); !ok || s != CallHungup {
+		t.Errorf("State returned %v, %v", s, ok)
+	}
+	tr.Feed(&Event{Header: EventHeader{"Event-Name": "CHANNEL_DESTROY", "Unique-Id": "abc"}})
+	if _, ok := tr.State("abc"); ok {
+		t.Error("Call still tracked after CHANNEL_DESTROY")
+	}
+}